@@ -15,28 +15,316 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// RawReceiver is a plain TCP listener of the endpoint for tools that can
+// only write to a socket, such as `tcpdump -w - | nc`. Each connection starts
+// with a preamble line of space separated key=value pairs: pod=<name> and
+// optionally tag=<tag>, namespace=<namespace> and job=<snoopyJob>. The rest of the connection is
+// stored the way gRPC streams are, in <filePath>/<pod>[-<tag>].
 type RawReceiver struct {
-	Port     string `json:"port,omitempty"`
+	// Port is where the raw listener takes connections, in the endpoint Pod
+	// and on the service. It must differ from Port and HTTPPort.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+
+	// FilePath is the directory raw streams are written to, the capture
+	// directory of the gRPC streams, /pcap, or a directory under it on the
+	// data volume. Defaults to the capture directory.
+	// +optional
 	FilePath string `json:"filePath,omitempty"`
 }
 
 // SnoopyDataEndpointSpec defines the desired state of SnoopyDataEndpoint.
 type SnoopyDataEndpointSpec struct {
 
-	// ServiceName is used to create the service for the gRPC endpoint.
-	ServiceName string `json:"serviceName"`
+	// ServiceName is the name of the service for the gRPC endpoint, in the
+	// namespace of the SnoopyDataEndpoint. Defaults to the name of the
+	// SnoopyDataEndpoint, which also names its deployment.
+	// +optional
+	ServiceName string `json:"serviceName,omitempty"`
 
 	// ServicePort is the exposed port on the service.
 	ServicePort int32 `json:"servicePort"`
+
+	// Replicas is the number of endpoint Pods. With more than one, each
+	// SnoopyJob target streams to the replica its name hashes to, so the
+	// captures of a Pod are all kept on the same replica.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Exposure makes the HTTP API of the endpoint reachable from outside the
+	// cluster, behind a bearer token.
+	// +optional
+	Exposure *Exposure `json:"exposure,omitempty"`
+
+	// Retention rotates and prunes the captured data. Without it the data
+	// of each target is appended to one file until the storage is full.
+	// +optional
+	Retention *Retention `json:"retention,omitempty"`
+
+	// RawReceiver also takes captures over plain TCP connections.
+	// +optional
+	RawReceiver *RawReceiver `json:"rawReceiver,omitempty"`
+
+	// Image is the endpoint server image. Defaults to the one released with the operator.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// ImagePullPolicy of the endpoint image.
+	// +optional
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+
+	// Port is where the endpoint server listens in its Pod, and the target
+	// port of the service.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +kubebuilder:default=51001
+	// +optional
+	Port int32 `json:"port,omitempty"`
+
+	// HTTPPort is where the endpoint server serves its HTTP API to browse
+	// and download the captures, in its Pod and on the service.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +kubebuilder:default=8080
+	// +optional
+	HTTPPort int32 `json:"httpPort,omitempty"`
+
+	// ExtraArgs are passed to the endpoint server after the port.
+	// +optional
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+
+	// Env is added to the environment of the endpoint server.
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+
+	// Resources of the endpoint server container.
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// NodeSelector, Affinity and Tolerations place the endpoint Pods.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// +optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// SecurityContext of the endpoint server container. Defaults to an
+	// unprivileged container without capabilities.
+	// +optional
+	SecurityContext *corev1.SecurityContext `json:"securityContext,omitempty"`
+
+	// PodSecurityContext of the endpoint Pods. Defaults to running as a
+	// non-root user and group 65532, which also owns the data volume.
+	// +optional
+	PodSecurityContext *corev1.PodSecurityContext `json:"podSecurityContext,omitempty"`
+
+	// Storage keeps the captured data on a PersistentVolumeClaim across
+	// restarts of the endpoint Pod. Without it the data lives in an
+	// emptyDir volume.
+	// +optional
+	Storage *Storage `json:"storage,omitempty"`
+}
+
+// Storage is the PersistentVolumeClaim a SnoopyDataEndpoint keeps its data on.
+// An existing claim is mounted as is, for a single replica. Otherwise each
+// replica gets a claim of its own from a StatefulSet.
+type Storage struct {
+	// ClaimName is an existing PersistentVolumeClaim to use, only with a
+	// single replica. The other fields only apply to the claims created for
+	// the SnoopyDataEndpoint.
+	// +optional
+	ClaimName string `json:"claimName,omitempty"`
+
+	// Size is the size of the claim of each replica.
+	// +kubebuilder:default="10Gi"
+	// +optional
+	Size *resource.Quantity `json:"size,omitempty"`
+
+	// StorageClassName is the storage class of the claims, the default one when empty.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// AccessModes of the claims. Defaults to ReadWriteOnce.
+	// +optional
+	AccessModes []corev1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
 }
 
+// Exposure makes the HTTP API of a SnoopyDataEndpoint reachable from outside
+// the cluster. The gRPC and raw ports only ever are on the ClusterIP service.
+type Exposure struct {
+	// TokenSecretName is a Secret of the namespace of the SnoopyDataEndpoint
+	// whose token key is the bearer token the HTTP API then requires. Nothing
+	// is exposed outside the cluster without it.
+	// +optional
+	TokenSecretName string `json:"tokenSecretName,omitempty"`
+
+	// Type of the service of the HTTP API: ClusterIP, NodePort or
+	// LoadBalancer. NodePort and LoadBalancer add a <serviceName>-external
+	// service with the HTTP port only.
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	// +kubebuilder:default=ClusterIP
+	// +optional
+	Type corev1.ServiceType `json:"type,omitempty"`
+
+	// ServiceAnnotations are set on the external service, to configure a cloud load balancer for instance.
+	// +optional
+	ServiceAnnotations map[string]string `json:"serviceAnnotations,omitempty"`
+
+	// LoadBalancerSourceRanges restricts the clients of a LoadBalancer service.
+	// +optional
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+
+	// Ingress exposes the HTTP API through an Ingress.
+	// +optional
+	Ingress *IngressExposure `json:"ingress,omitempty"`
+
+	// Route exposes the HTTP API through an OpenShift Route. It is only
+	// created where the route.openshift.io API is served.
+	// +optional
+	Route *RouteExposure `json:"route,omitempty"`
+}
+
+// IngressExposure is the Ingress of the HTTP API of a SnoopyDataEndpoint.
+type IngressExposure struct {
+	// Host the Ingress answers for.
+	Host string `json:"host"`
+
+	// IngressClassName picks the ingress controller, the default one when empty.
+	// +optional
+	IngressClassName *string `json:"ingressClassName,omitempty"`
+
+	// TLSSecretName is the secret holding the certificate of the host. The
+	// Ingress serves plain HTTP without it.
+	// +optional
+	TLSSecretName string `json:"tlsSecretName,omitempty"`
+
+	// Annotations are set on the Ingress, to configure its controller.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// RouteExposure is the OpenShift Route of the HTTP API of a SnoopyDataEndpoint.
+type RouteExposure struct {
+	// Host of the Route. The router generates one when empty.
+	// +optional
+	Host string `json:"host,omitempty"`
+
+	// TLSTermination is edge, or empty to serve plain HTTP.
+	// +kubebuilder:validation:Enum="";edge
+	// +optional
+	TLSTermination string `json:"tlsTermination,omitempty"`
+}
+
+// Retention limits how much captured data an endpoint keeps. The data of a
+// stream goes to <pod>.<run>.<segment> files, moving on to the next segment
+// at the capture limits. The endpoint prunes the files no stream is writing
+// to in the background.
+type Retention struct {
+	// MaxAge prunes captures last written longer ago.
+	// +optional
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+
+	// MaxTotalSize prunes the oldest captures while the captures of an
+	// endpoint Pod take more space.
+	// +optional
+	MaxTotalSize *resource.Quantity `json:"maxTotalSize,omitempty"`
+
+	// MaxCaptureSize rotates a capture reaching this size.
+	// +optional
+	MaxCaptureSize *resource.Quantity `json:"maxCaptureSize,omitempty"`
+
+	// RotationInterval rotates a capture written for this long.
+	// +optional
+	RotationInterval *metav1.Duration `json:"rotationInterval,omitempty"`
+
+	// KeepRuns is how many of the last runs of each target are kept.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	KeepRuns *int32 `json:"keepRuns,omitempty"`
+}
+
+// Condition types of a SnoopyDataEndpoint.
+const (
+	// ConditionReady is true when the endpoint takes streams.
+	ConditionReady = "Ready"
+	// ConditionDegraded is true when some replicas are missing or failing.
+	ConditionDegraded = "Degraded"
+	// ConditionExposed is true when the requested exposure could be set up.
+	ConditionExposed = "Exposed"
+)
+
 // SnoopyDataEndpointStatus defines the observed state of SnoopyDataEndpoint.
 type SnoopyDataEndpointStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster.
-	// Important: Run "make" to regenerate code after modifying this file.
+	// Replicas is the number of endpoint Pods.
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// ReadyReplicas is the number of endpoint Pods ready to take streams.
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// Address is the in-cluster host:port SnoopyJobs stream to.
+	Address string `json:"address,omitempty"`
+
+	// ExternalAddresses are where the endpoint is reached from outside the
+	// cluster: the load balancer of the service as host:port, and the URL of
+	// the HTTP API on the Ingress or the Route.
+	// +optional
+	ExternalAddresses []string `json:"externalAddresses,omitempty"`
+
+	// ReplicaAddresses are the in-cluster host:port of each endpoint Pod,
+	// by ordinal, when there are several replicas.
+	// +optional
+	ReplicaAddresses []string `json:"replicaAddresses,omitempty"`
+
+	// Conditions mirror the state of the endpoint workload.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Ingest sums up what the endpoint Pods report.
+	// +optional
+	Ingest *IngestStats `json:"ingest,omitempty"`
+}
+
+// IngestStats are the live statistics of the endpoint servers.
+type IngestStats struct {
+	// ActiveStreams is the number of streams being received.
+	ActiveStreams int32 `json:"activeStreams"`
+
+	// BytesReceived is the number of bytes received since the servers started.
+	BytesReceived int64 `json:"bytesReceived"`
+
+	// StorageUsed is the space used where the captures are written.
+	StorageUsed *resource.Quantity `json:"storageUsed,omitempty"`
+
+	// StorageCapacity is the size of the storage the captures are written to.
+	StorageCapacity *resource.Quantity `json:"storageCapacity,omitempty"`
+
+	// PrunedFiles is the number of capture files removed by the retention
+	// policy since the servers started.
+	// +optional
+	PrunedFiles int64 `json:"prunedFiles,omitempty"`
+
+	// PrunedBytes is the size of the capture files removed by the retention
+	// policy since the servers started.
+	// +optional
+	PrunedBytes int64 `json:"prunedBytes,omitempty"`
+
+	// LastPruneTime is when capture files were last removed.
+	// +optional
+	LastPruneTime *metav1.Time `json:"lastPruneTime,omitempty"`
+
+	// UpdateTime is when the statistics last changed.
+	UpdateTime metav1.Time `json:"updateTime"`
 }
 
 //+kubebuilder:object:root=true
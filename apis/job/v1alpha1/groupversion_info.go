@@ -13,8 +13,8 @@
 // limitations under the License.
 
 // Package v1alpha1 contains API Schema definitions for the job v1alpha1 API group.
-//+kubebuilder:object:generate=true.
-//+groupName=job.fennecproject.io.
+//+kubebuilder:object:generate=true
+//+groupName=job.fennecproject.io
 package v1alpha1
 
 import (
@@ -0,0 +1,182 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SnoopyConnectivityCheckSpec defines the desired state of SnoopyConnectivityCheck.
+type SnoopyConnectivityCheckSpec struct {
+	// Source selects the Pods the probes are run from.
+	Source PodSelector `json:"source"`
+
+	// Destinations are probed from every source Pod.
+	// +kubebuilder:validation:MinItems=1
+	// +listType=map
+	// +listMapKey=name
+	Destinations []Destination `json:"destinations"`
+
+	Probe Probe `json:"probe"`
+
+	// Schedule runs the probes again on a cron schedule. Without it they run once.
+	// +optional
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// PodSelector selects Pods by label in a namespace.
+type PodSelector struct {
+	LabelSelector map[string]string `json:"labelSelector"`
+
+	Namespace string `json:"namespace"`
+}
+
+// Destination is probed from the source Pods. Exactly one of Pods, Service
+// and Host is set.
+type Destination struct {
+	// Name identifies the destination in the results.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:MaxLength=50
+	Name string `json:"name"`
+
+	// Pods are probed on their IP, each one a destination of its own in the
+	// results. DNS probes need a name and do not take them.
+	// +optional
+	Pods *PodSelector `json:"pods,omitempty"`
+
+	// Service is probed on its cluster DNS name.
+	// +optional
+	Service *ServiceReference `json:"service,omitempty"`
+
+	// Host is an external host name or IP address. DNS probes only take names.
+	// +optional
+	Host string `json:"host,omitempty"`
+}
+
+// ServiceReference names a Service.
+type ServiceReference struct {
+	Name string `json:"name"`
+
+	Namespace string `json:"namespace"`
+}
+
+// ProbeType is the kind of probe run against the destinations.
+// +kubebuilder:validation:Enum=ICMP;TCP;HTTP;DNS
+type ProbeType string
+
+const (
+	// ICMPProbe pings the destination.
+	ICMPProbe ProbeType = "ICMP"
+	// TCPProbe opens a TCP connection to the destination port.
+	TCPProbe ProbeType = "TCP"
+	// HTTPProbe sends an HTTP GET request to the destination.
+	HTTPProbe ProbeType = "HTTP"
+	// DNSProbe resolves the destination name.
+	DNSProbe ProbeType = "DNS"
+)
+
+// Probe describes how destinations are probed.
+type Probe struct {
+	Type ProbeType `json:"type"`
+
+	// Port is the destination port of TCP and HTTP probes. HTTP defaults to 80.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	Port int32 `json:"port,omitempty"`
+
+	// Path is the path requested by HTTP probes.
+	// +kubebuilder:default="/"
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// Count is how many probes are sent to each destination per run.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +kubebuilder:default=3
+	// +optional
+	Count int32 `json:"count,omitempty"`
+
+	// TimeoutSeconds bounds each probe.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=2
+	// +optional
+	TimeoutSeconds int32 `json:"timeoutSeconds,omitempty"`
+}
+
+// SnoopyConnectivityCheckStatus defines the observed state of SnoopyConnectivityCheck.
+type SnoopyConnectivityCheckStatus struct {
+	// SnoopyJob is the name of the SnoopyJob running the probes.
+	SnoopyJob string `json:"snoopyJob,omitempty"`
+
+	// Results is the source by destination matrix of the latest run.
+	Results []ConnectivityResult `json:"results,omitempty"`
+
+	// Message tells why no probes run.
+	Message string `json:"message,omitempty"`
+}
+
+// ConnectivityResult sums up the probes from a source Pod to a destination.
+type ConnectivityResult struct {
+	// Source is the name of the source Pod.
+	Source string `json:"source"`
+
+	// Destination is the name of the destination.
+	Destination string `json:"destination"`
+
+	// Address is the IP address or host name probed.
+	Address string `json:"address"`
+
+	Sent      int32 `json:"sent"`
+	Succeeded int32 `json:"succeeded"`
+
+	// SuccessRate is the percentage of successful probes.
+	SuccessRate int32 `json:"successRate"`
+
+	// Latency is the average latency of the successful probes.
+	// +optional
+	Latency *metav1.Duration `json:"latency,omitempty"`
+
+	// Message explains why no probe could be sent.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	ProbeTime *metav1.Time `json:"probeTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// SnoopyConnectivityCheck is the Schema for the snoopyconnectivitychecks API.
+type SnoopyConnectivityCheck struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SnoopyConnectivityCheckSpec   `json:"spec,omitempty"`
+	Status SnoopyConnectivityCheckStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SnoopyConnectivityCheckList contains a list of SnoopyConnectivityCheck.
+type SnoopyConnectivityCheckList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SnoopyConnectivityCheck `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SnoopyConnectivityCheck{}, &SnoopyConnectivityCheckList{})
+}
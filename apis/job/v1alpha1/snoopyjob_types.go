@@ -15,6 +15,8 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -28,31 +30,572 @@ type SnoopyJobSpec struct {
 	Command string `json:"command,omitempty"`
 
 	// Args is a string containing all arguments for a given command.
+	// It is a Go template over the target .Pod or .Node and the .Peer Pods,
+	// for example "host {{ .Pod.IP }}".
 	Args string `json:"args,omitempty"`
 
 	// LabelSelector is the label to find the target Pods.
 	LabelSelector map[string]string `json:"labelSelector,omitempty"`
 
+	// TargetRef finds the target Pods through a Service or a workload in
+	// TargetNamespace instead of LabelSelector.
+	// +optional
+	TargetRef *TargetRef `json:"targetRef,omitempty"`
+
 	// TargetNamespace is the k8s where the target Pod lives.
 	TargetNamespace string `json:"targetNamespace,omitempty"`
 
+	// Sampling limits how many of the selected Pods are targeted.
+	// +optional
+	Sampling *Sampling `json:"sampling,omitempty"`
+
+	// TargetNodes selects Nodes to run the command against in their host
+	// network namespace. Pods are still targeted when LabelSelector is set.
+	// +optional
+	TargetNodes *TargetNodes `json:"targetNodes,omitempty"`
+
 	// The schedule in Cron format, see https://en.wikipedia.org/wiki/Cron.
 	Schedule string `json:"schedule,omitempty"`
 
+	// ActiveFrom is when the SnoopyJob starts running. Defaults to now.
+	// +optional
+	ActiveFrom *metav1.Time `json:"activeFrom,omitempty"`
+
+	// ActiveUntil is when the SnoopyJob stops running. Its CronJobs are
+	// suspended and running Jobs are stopped at that time.
+	// +optional
+	ActiveUntil *metav1.Time `json:"activeUntil,omitempty"`
+
+	// MaxRuns is the number of scheduled runs after which CronJobs are suspended.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxRuns *int32 `json:"maxRuns,omitempty"`
+
 	// Timer sets how much time to run the specified command.
 	// Valid example values are 10s, 2m, 1h etc.
 	Timer string `json:"timer,omitempty"`
 
+	// StopCondition ends a run before its Timer expires. The Timer stays
+	// the upper bound of every run.
+	// +optional
+	StopCondition *StopCondition `json:"stopCondition,omitempty"`
+
+	// Peers selects the Pods available to argument templates as .Peer and .Peers.
+	// +optional
+	Peers *PeerSelector `json:"peers,omitempty"`
+
+	// RetryPolicy runs a target again when its run fails.
+	// +optional
+	RetryPolicy *RetryPolicy `json:"retryPolicy,omitempty"`
+
+	// ExitCodeRules tell how the way a step ended turns into an outcome.
+	// The first matching rule wins. Without a match, a step exiting with 0,
+	// allowed to fail or stopped by a stop condition succeeds and any other
+	// failure is retried.
+	// +optional
+	ExitCodeRules []ExitCodeRule `json:"exitCodeRules,omitempty"`
+
+	// DryRun discovers the targets and renders the Jobs or CronJobs into
+	// a ConfigMap without creating them.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Stop cancels the SnoopyJob: running workers are deleted, streams sent
+	// to the data endpoint are finalized as truncated and the results so
+	// far are kept.
+	// +optional
+	Stop bool `json:"stop,omitempty"`
+
+	// SynchronizedStart holds the workers until all of them are ready and
+	// starts them at a shared wall clock time.
+	// +optional
+	SynchronizedStart *SynchronizedStart `json:"synchronizedStart,omitempty"`
+
+	// ConflictPolicy tells what happens to targets another SnoopyJob is
+	// already capturing. Queue waits for the other SnoopyJob to be done with
+	// the target, Reject leaves the target out.
+	// +kubebuilder:default=Queue
+	// +optional
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty"`
+
 	// Ip address for the DataEndpoint where to send collected data.
 	DataServiceIP string `json:"dataServiceIP,omitempty"`
 
 	// Port used by the data service on the data endpoint.
 	DataServicePort string `json:"dataServicePort,omitempty"`
+
+	// Steps is an ordered list of commands run one after the other against
+	// the same target in a single worker Pod. When set, Command and Args are ignored.
+	// Several steps streaming to a data endpoint need a podtracer image
+	// tagging each stream with its step, the SnoopyJob is rejected otherwise.
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Steps []Step `json:"steps,omitempty"`
+
+	// Output selects where the command output goes. Defaults to the data
+	// endpoint when DataServiceIP is set.
+	// +optional
+	Output *Output `json:"output,omitempty"`
+}
+
+// RetryPolicy bounds how often and how fast a failed run is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of runs of a target, the first one included.
+	// Scheduled SnoopyJobs retry within each scheduled run through the Job backoff limit.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=3
+	// +optional
+	MaxAttempts int32 `json:"maxAttempts,omitempty"`
+
+	// Backoff is the delay before the second attempt, doubled for each following one.
+	// +kubebuilder:default="10s"
+	// +optional
+	Backoff *metav1.Duration `json:"backoff,omitempty"`
+}
+
+// ConflictPolicy is what happens to a target held by another SnoopyJob.
+// +kubebuilder:validation:Enum=Queue;Reject
+type ConflictPolicy string
+
+const (
+	// ConflictQueue waits for the target to be released.
+	ConflictQueue ConflictPolicy = "Queue"
+	// ConflictReject leaves the target out for good.
+	ConflictReject ConflictPolicy = "Reject"
+)
+
+// SynchronizedStart tunes how the workers of a SnoopyJob start together.
+type SynchronizedStart struct {
+	// Lead is how far in the future the shared start time is set once all
+	// workers are ready, leaving time for the workers to learn about it.
+	// +kubebuilder:default="10s"
+	// +optional
+	Lead *metav1.Duration `json:"lead,omitempty"`
+
+	// Timeout is how long ready workers wait for the others before they
+	// start without them. Workers ready later start right away.
+	// +kubebuilder:default="5m"
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// StepOutcome is what the end of a step means for the run of a target.
+// +kubebuilder:validation:Enum=Success;Retry;PermanentFailure
+type StepOutcome string
+
+const (
+	// StepOutcomeSuccess counts the step as successful whatever its exit code.
+	StepOutcomeSuccess StepOutcome = "Success"
+	// StepOutcomeRetry fails the run and lets the RetryPolicy run it again.
+	StepOutcomeRetry StepOutcome = "Retry"
+	// StepOutcomePermanentFailure fails the run without any retry.
+	StepOutcomePermanentFailure StepOutcome = "PermanentFailure"
+)
+
+// ExitCodeRule maps the exit code and output of a step to an outcome. All
+// the fields set have to match.
+type ExitCodeRule struct {
+	// Step restricts the rule to a step. Empty matches all steps.
+	// +optional
+	Step string `json:"step,omitempty"`
+
+	// ExitCodes the rule applies to. Empty matches any exit code.
+	// +optional
+	ExitCodes []int32 `json:"exitCodes,omitempty"`
+
+	// OutputPattern is a regular expression matched against the last lines
+	// of the step output, for example "No such device".
+	// +optional
+	OutputPattern string `json:"outputPattern,omitempty"`
+
+	Outcome StepOutcome `json:"outcome"`
+}
+
+// PeerSelector selects the peer Pods of the targets of a SnoopyJob.
+type PeerSelector struct {
+	// LabelSelector selects the peer Pods.
+	LabelSelector map[string]string `json:"labelSelector"`
+
+	// Namespace of the peer Pods. Defaults to TargetNamespace.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
 }
 
+// StopCondition lists the conditions ending a run early. The first one met stops the run.
+type StopCondition struct {
+	// MaxBytes stops a step once it has written this much output.
+	// +optional
+	MaxBytes *resource.Quantity `json:"maxBytes,omitempty"`
+
+	// MaxPackets stops tcpdump steps after capturing this many packets.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxPackets *int64 `json:"maxPackets,omitempty"`
+
+	// Pattern is a regular expression stopping a step once a line of its
+	// output matches it.
+	// +optional
+	Pattern string `json:"pattern,omitempty"`
+
+	// TargetCondition stops the run of a target Pod once the Pod condition
+	// reaches the given status, for example when the Pod becomes Ready again.
+	// +optional
+	TargetCondition *TargetCondition `json:"targetCondition,omitempty"`
+}
+
+// TargetCondition is a condition of a target Pod watched by the operator.
+type TargetCondition struct {
+	// Type is the Pod condition type, such as Ready or ContainersReady.
+	Type corev1.PodConditionType `json:"type"`
+
+	// Status is the condition status stopping the run.
+	// +kubebuilder:validation:Enum=True;False;Unknown
+	// +kubebuilder:default=True
+	// +optional
+	Status corev1.ConditionStatus `json:"status,omitempty"`
+}
+
+// StopReason tells which stop condition ended a step.
+type StopReason string
+
+const (
+	// StopReasonMaxBytes is set when the step output reached MaxBytes.
+	StopReasonMaxBytes StopReason = "MaxBytes"
+	// StopReasonPattern is set when the step output matched Pattern.
+	StopReasonPattern StopReason = "Pattern"
+	// StopReasonTargetCondition is set when the target Pod reached TargetCondition.
+	StopReasonTargetCondition StopReason = "TargetCondition"
+	// StopReasonStopped is set when the SnoopyJob was stopped.
+	StopReasonStopped StopReason = "Stopped"
+)
+
+// OutputSinkType is where the output of a SnoopyJob run is written.
+type OutputSinkType string
+
+const (
+	// DataEndpointSink streams the output to the data endpoint at DataServiceIP.
+	DataEndpointSink OutputSinkType = "DataEndpoint"
+	// PersistentVolumeClaimSink writes the output to a PVC mounted into the worker.
+	PersistentVolumeClaimSink OutputSinkType = "PersistentVolumeClaim"
+	// ConfigMapSink stores the output of small text commands in a ConfigMap.
+	ConfigMapSink OutputSinkType = "ConfigMap"
+)
+
+// Output defines where the output of a SnoopyJob run is written.
+type Output struct {
+	// +kubebuilder:validation:Enum=DataEndpoint;PersistentVolumeClaim;ConfigMap
+	Type OutputSinkType `json:"type"`
+
+	// PersistentVolumeClaim is the claim used by the PersistentVolumeClaim sink.
+	// +optional
+	PersistentVolumeClaim *PersistentVolumeClaimOutput `json:"persistentVolumeClaim,omitempty"`
+
+	// ConfigMap configures the ConfigMap sink.
+	// +optional
+	ConfigMap *ConfigMapOutput `json:"configMap,omitempty"`
+}
+
+// PersistentVolumeClaimOutput writes each run under <targetNamespace>/<targetPod>/<run>/<step>,
+// or nodes/<targetNode>/<run>/<step>, on an existing claim in the snoopy-operator namespace.
+type PersistentVolumeClaimOutput struct {
+	// ClaimName is the name of the PersistentVolumeClaim to mount.
+	ClaimName string `json:"claimName"`
+}
+
+// ConfigMapOutput stores the output of each run in a ConfigMap with a key per step.
+type ConfigMapOutput struct {
+	// MaxSize caps the size of the output stored in each ConfigMap.
+	// Output beyond it is truncated. Defaults to 512Ki, can't exceed 1000Ki.
+	// +optional
+	MaxSize *resource.Quantity `json:"maxSize,omitempty"`
+}
+
+// TargetRef references the Service or workload whose Pods are targeted.
+// A Service is resolved to the Pods backing its ready endpoints, a workload
+// to the Pods it owns.
+type TargetRef struct {
+	// +kubebuilder:validation:Enum=Service;Deployment;StatefulSet;DaemonSet
+	Kind string `json:"kind"`
+
+	Name string `json:"name"`
+}
+
+// SamplingMode is how sampled Pods are chosen.
+type SamplingMode string
+
+const (
+	// RandomSampling picks Pods at random.
+	RandomSampling SamplingMode = "Random"
+	// DeterministicSampling picks Pods by a stable hash of the SnoopyJob and Pod names.
+	DeterministicSampling SamplingMode = "Deterministic"
+)
+
+// Sampling picks a subset of the target Pods. When both Count and Percentage
+// are set the smallest one wins. Chosen Pods are kept while they exist and
+// replaced when they go away. Target Nodes are never sampled.
+type Sampling struct {
+	// Count is the number of Pods to target.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Count *int32 `json:"count,omitempty"`
+
+	// Percentage of the selected Pods to target, rounded up.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	Percentage *int32 `json:"percentage,omitempty"`
+
+	// MaxPerNode is the maximum number of Pods targeted on a single Node.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxPerNode *int32 `json:"maxPerNode,omitempty"`
+
+	// +kubebuilder:validation:Enum=Random;Deterministic
+	// +kubebuilder:default=Random
+	// +optional
+	Mode SamplingMode `json:"mode,omitempty"`
+}
+
+// TargetNodes selects Nodes by name or by label.
+type TargetNodes struct {
+	// Names lists the target Nodes by name.
+	Names []string `json:"names,omitempty"`
+
+	// LabelSelector is the label to find the target Nodes.
+	LabelSelector map[string]string `json:"labelSelector,omitempty"`
+}
+
+// Step is a single podtracer command run as part of a SnoopyJob.
+type Step struct {
+	// Name identifies the step. The step output streamed to the data endpoint is tagged with it.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:MaxLength=50
+	Name string `json:"name"`
+
+	// Command is any linux binary that can be run by podtracer in the context of a Pod.
+	Command string `json:"command"`
+
+	// Args is a string containing all arguments for the command, rendered
+	// as a Go template like the SnoopyJob Args.
+	Args string `json:"args,omitempty"`
+
+	// Timeout sets how much time to run the step command.
+	// Valid example values are 10s, 2m, 1h etc. Defaults to Timer.
+	Timeout string `json:"timeout,omitempty"`
+
+	// ContinueOnError runs the following steps even if this one fails.
+	ContinueOnError bool `json:"continueOnError,omitempty"`
+}
+
+// StepPhase is the state of a step on a given target.
+type StepPhase string
+
+const (
+	StepPending   StepPhase = "Pending"
+	StepRunning   StepPhase = "Running"
+	StepSucceeded StepPhase = "Succeeded"
+	StepFailed    StepPhase = "Failed"
+	StepSkipped   StepPhase = "Skipped"
+)
+
+// StepResult is the outcome of the latest run of a step against a target Pod.
+type StepResult struct {
+	// Target is the name of the target Pod, or node-<name> for a target Node.
+	Target string `json:"target"`
+
+	// Step is the name of the step.
+	Step string `json:"step"`
+
+	Phase StepPhase `json:"phase"`
+
+	// ExitCode is the exit code of the step command once it has finished.
+	ExitCode *int32 `json:"exitCode,omitempty"`
+
+	StartTime  *metav1.Time `json:"startTime,omitempty"`
+	FinishTime *metav1.Time `json:"finishTime,omitempty"`
+
+	// StopReason is set when a stop condition ended the step before its Timer.
+	StopReason StopReason `json:"stopReason,omitempty"`
+
+	Message string `json:"message,omitempty"`
+}
+
+// SnoopyJobPhase is the lifecycle phase of a SnoopyJob.
+type SnoopyJobPhase string
+
+const (
+	// SnoopyJobPending waits for ActiveFrom.
+	SnoopyJobPending SnoopyJobPhase = "Pending"
+	// SnoopyJobActive runs inside its activation window.
+	SnoopyJobActive SnoopyJobPhase = "Active"
+	// SnoopyJobExpired has reached ActiveUntil or MaxRuns.
+	SnoopyJobExpired SnoopyJobPhase = "Expired"
+	// SnoopyJobStopped was cancelled through Stop.
+	SnoopyJobStopped SnoopyJobPhase = "Stopped"
+	// SnoopyJobRejected asks for what the podtracer image of the workers does not support.
+	SnoopyJobRejected SnoopyJobPhase = "Rejected"
+)
+
 // SnoopyJobStatus defines the observed state of SnoopyJob.
 type SnoopyJobStatus struct {
+	Phase SnoopyJobPhase `json:"phase,omitempty"`
+
+	// Message tells why the SnoopyJob was rejected.
+	Message string `json:"message,omitempty"`
+
+	// CronJobList names the Jobs or CronJobs running the targets, up to 100 of them.
 	CronJobList []string `json:"cronJobList,omitempty"`
+
+	// Workers counts the Jobs or CronJobs running the targets.
+	Workers int32 `json:"workers,omitempty"`
+
+	// TargetCounts counts the targets by the outcome of their latest run.
+	// The per-target lists below keep up to 100 entries, those needing a
+	// look first, so the status stays small whatever the number of targets.
+	TargetCounts *TargetCounts `json:"targetCounts,omitempty"`
+
+	// ScheduledRuns counts the runs started by the CronJobs.
+	ScheduledRuns int32 `json:"scheduledRuns,omitempty"`
+
+	// LastScheduleTime is the last time a run was started by the CronJobs.
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+
+	// StepResults records the result of each step on each target, failed
+	// and unfinished ones first.
+	StepResults []StepResult `json:"stepResults,omitempty"`
+
+	// Artifacts records where the output of the latest runs ended up, the most recent ones.
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+
+	// PrunedArtifacts counts the artifacts recorded and since left out of Artifacts.
+	PrunedArtifacts int32 `json:"prunedArtifacts,omitempty"`
+
+	// SampledTargets lists the Pods chosen by Sampling, the first ones of
+	// SampledCount.
+	SampledTargets []string `json:"sampledTargets,omitempty"`
+
+	// SampledCount counts the Pods chosen by Sampling.
+	SampledCount int32 `json:"sampledCount,omitempty"`
+
+	// Outcomes records the outcome of the latest run of the targets that
+	// failed, were stopped or are being retried.
+	Outcomes []TargetOutcome `json:"outcomes,omitempty"`
+
+	// DryRunConfigMap is the ConfigMap holding the output of the latest dry run.
+	DryRunConfigMap string `json:"dryRunConfigMap,omitempty"`
+
+	// TemplateErrors lists the targets left out because their arguments
+	// could not be rendered.
+	TemplateErrors []TemplateError `json:"templateErrors,omitempty"`
+
+	// StartTime is the shared start time of the latest synchronized start.
+	StartTime *metav1.MicroTime `json:"startTime,omitempty"`
+
+	// StartSkews records how far from the shared start time each target
+	// actually started, the largest skews.
+	StartSkews []StartSkew `json:"startSkews,omitempty"`
+
+	// Conflicts lists the targets held by another SnoopyJob. Rejected targets are all kept.
+	Conflicts []TargetConflict `json:"conflicts,omitempty"`
+}
+
+// TargetCounts counts targets by outcome.
+type TargetCounts struct {
+	Running   int32 `json:"running,omitempty"`
+	Retrying  int32 `json:"retrying,omitempty"`
+	Succeeded int32 `json:"succeeded,omitempty"`
+	Failed    int32 `json:"failed,omitempty"`
+	Stopped   int32 `json:"stopped,omitempty"`
+}
+
+// TargetConflict is a target another SnoopyJob is capturing.
+type TargetConflict struct {
+	// Target is the name of the target Pod, or node-<name> for a target Node.
+	Target string `json:"target"`
+
+	// BlockedBy is the namespace/name of the SnoopyJob holding the target.
+	BlockedBy string `json:"blockedBy"`
+
+	// Rejected is true when the target was left out, false while it is queued.
+	Rejected bool `json:"rejected,omitempty"`
+}
+
+// StartSkew is the actual start of a synchronized worker.
+type StartSkew struct {
+	// Target is the name of the target Pod, or node-<name> for a target Node.
+	Target string `json:"target"`
+
+	// Run is the name of the worker Pod.
+	Run string `json:"run"`
+
+	// StartedAt is when the worker actually started.
+	StartedAt metav1.MicroTime `json:"startedAt"`
+
+	// Skew is how late the worker started, negative when early.
+	Skew metav1.Duration `json:"skew"`
+}
+
+// TargetOutcomeType is where the run of a target stands.
+type TargetOutcomeType string
+
+const (
+	// TargetRunning runs or waits for its next attempt to start.
+	TargetRunning TargetOutcomeType = "Running"
+	// TargetRetrying failed and waits for the backoff before the next attempt.
+	TargetRetrying TargetOutcomeType = "Retrying"
+	// TargetSucceeded ran successfully.
+	TargetSucceeded TargetOutcomeType = "Succeeded"
+	// TargetFailed failed for good, permanently or after its last attempt.
+	TargetFailed TargetOutcomeType = "Failed"
+	// TargetStopped was cut short by stopping the SnoopyJob.
+	TargetStopped TargetOutcomeType = "Stopped"
+)
+
+// TargetOutcome is the outcome of the latest run of a target.
+type TargetOutcome struct {
+	// Target is the name of the target Pod, or node-<name> for a target Node.
+	Target string `json:"target"`
+
+	Outcome TargetOutcomeType `json:"outcome"`
+
+	// Attempts is the number of attempts started.
+	Attempts int32 `json:"attempts"`
+
+	// NextAttemptTime is when the next attempt starts while Retrying.
+	NextAttemptTime *metav1.Time `json:"nextAttemptTime,omitempty"`
+
+	Message string `json:"message,omitempty"`
+}
+
+// TemplateError is an error rendering the arguments of a step for a target.
+type TemplateError struct {
+	// Target is the name of the target Pod, or node-<name> for a target Node.
+	Target string `json:"target"`
+
+	// Step is the name of the step.
+	Step string `json:"step"`
+
+	Message string `json:"message"`
+}
+
+// Artifact is the location of the output of a run against a target Pod.
+type Artifact struct {
+	// Target is the name of the target Pod, or node-<name> for a target Node.
+	Target string `json:"target"`
+
+	// Run is the name of the worker Pod that produced the output.
+	Run string `json:"run"`
+
+	Sink OutputSinkType `json:"sink"`
+
+	// Location is where the output can be found for the given sink.
+	Location string `json:"location"`
+
+	// Truncated is set when the output didn't fit in the sink.
+	Truncated bool `json:"truncated,omitempty"`
+
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
 }
 
 //+kubebuilder:object:root=true
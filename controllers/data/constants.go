@@ -14,7 +14,46 @@
 
 package data
 
+import "time"
+
 const (
 	serviceAccountName = "snoopy-operator-sa"
-	dataEndpointImage  = "quay.io/fennec-project/snoopy-data-endpoint:0.0.1-4"
+	dataEndpointImage  = "quay.io/fennec-project/snoopy-data-endpoint:0.0.1-5"
+
+	// fieldOwner is the field manager of the resources applied by the operator.
+	fieldOwner = "snoopy-operator"
+
+	// operatorNamespace is where the operator and its service account live.
+	operatorNamespace = "snoopy-operator"
+
+	// dataEndpointLabel tells apart the Pods of each SnoopyDataEndpoint.
+	dataEndpointLabel = "snoopyDataEndpoint"
+
+	// dataEndpointPort is where the gRPC server listens in the endpoint Pod by default.
+	dataEndpointPort = 51001
+
+	// dataEndpointHTTPPort is where the HTTP API listens in the endpoint Pod by default.
+	dataEndpointHTTPPort = 8080
+
+	// The data volume is mounted where the endpoint server writes the captures.
+	dataVolumeName = "pcap"
+	captureDir     = "/pcap"
+
+	// The token Secret of an exposed endpoint is mounted where the HTTP API reads its bearer token.
+	tokenVolumeName = "http-token"
+	tokenMountPath  = "/etc/snoopy/http-token"
+	tokenSecretKey  = "token"
+
+	// endpointUserID is the unprivileged user and group the endpoint server
+	// runs as by default, owning the data volume.
+	endpointUserID = 65532
+
+	// defaultStorageSize is the size of the claim of each replica, see Storage.
+	defaultStorageSize = "10Gi"
+
+	// statsPollInterval is how often the ingest statistics of the endpoint Pods are collected.
+	statsPollInterval = 30 * time.Second
+
+	// statsTimeout bounds the call reading the statistics of an endpoint Pod.
+	statsTimeout = 5 * time.Second
 )
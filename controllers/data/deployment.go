@@ -16,6 +16,8 @@ package data
 
 import (
 	"log"
+	"path"
+	"strconv"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -28,37 +30,23 @@ import (
 
 func (r *SnoopyDataEndpointReconciler) deploymentForDataEndpoint(dataEndpoint *datav1alpha1.SnoopyDataEndpoint, objectMeta metav1.ObjectMeta) client.Object {
 
-	privmode := true
-
 	deploy := &appsv1.Deployment{
 		ObjectMeta: objectMeta,
 		Spec: appsv1.DeploymentSpec{
+			Replicas: endpointReplicas(dataEndpoint),
 			Selector: &metav1.LabelSelector{
 				MatchLabels: objectMeta.Labels,
 			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: objectMeta.Labels,
-				},
-				Spec: corev1.PodSpec{
-					ServiceAccountName: serviceAccountName,
-					Containers: []corev1.Container{{
-						Name:            objectMeta.Name,
-						Image:           dataEndpointImage,
-						ImagePullPolicy: corev1.PullAlways,
-						Command:         []string{"/server"},
-						Args:            []string{"51001"},
-						SecurityContext: &corev1.SecurityContext{
-							Privileged: &privmode,
-						},
-						Ports: []corev1.ContainerPort{{
-							ContainerPort: 51001,
-						}},
-					}},
-				},
-			},
+			Template: podTemplateForDataEndpoint(dataEndpoint, objectMeta),
 		},
 	}
+
+	// A ReadWriteOnce claim can't be attached to the old and the new Pod at
+	// once during a rolling update.
+	if storage := dataEndpoint.Spec.Storage; storage != nil && storage.ClaimName != "" {
+		deploy.Spec.Strategy = appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}
+	}
+
 	// Set dataEndpoint instance as the owner and controller.
 	if err := controllerutil.SetControllerReference(dataEndpoint, deploy, r.Scheme); err != nil {
 		log.Fatal(err)
@@ -66,3 +54,164 @@ func (r *SnoopyDataEndpointReconciler) deploymentForDataEndpoint(dataEndpoint *d
 
 	return deploy
 }
+
+// retentionArgs passes the retention policy of a SnoopyDataEndpoint to the endpoint server.
+func retentionArgs(retention *datav1alpha1.Retention) []string {
+
+	args := []string{}
+	if retention == nil {
+		return args
+	}
+
+	if retention.MaxAge != nil {
+		args = append(args, "-max-age", retention.MaxAge.Duration.String())
+	}
+	if retention.MaxTotalSize != nil {
+		args = append(args, "-max-total-size", strconv.FormatInt(retention.MaxTotalSize.Value(), 10))
+	}
+	if retention.MaxCaptureSize != nil {
+		args = append(args, "-max-capture-size", strconv.FormatInt(retention.MaxCaptureSize.Value(), 10))
+	}
+	if retention.RotationInterval != nil {
+		args = append(args, "-rotation-interval", retention.RotationInterval.Duration.String())
+	}
+	if retention.KeepRuns != nil {
+		args = append(args, "-keep-runs", strconv.Itoa(int(*retention.KeepRuns)))
+	}
+
+	return args
+}
+
+// podTemplateForDataEndpoint builds the endpoint Pod of a Deployment or a
+// StatefulSet. The data volume is mounted at the capture directory when
+// there is storage. An existing claim is added here, claim templates are
+// added by the StatefulSet itself.
+func podTemplateForDataEndpoint(dataEndpoint *datav1alpha1.SnoopyDataEndpoint, objectMeta metav1.ObjectMeta) corev1.PodTemplateSpec {
+
+	args := []string{strconv.Itoa(int(endpointPort(dataEndpoint))), "-http-port", strconv.Itoa(int(endpointHTTPPort(dataEndpoint)))}
+	ports := []corev1.ContainerPort{{
+		Name:          "grpc",
+		ContainerPort: endpointPort(dataEndpoint),
+	}, {
+		Name:          "http",
+		ContainerPort: endpointHTTPPort(dataEndpoint),
+	}}
+	if raw := dataEndpoint.Spec.RawReceiver; raw != nil {
+		rawDir := captureDir
+		if raw.FilePath != "" {
+			rawDir = path.Clean(raw.FilePath)
+		}
+		args = append(args, "-raw-port", strconv.Itoa(int(raw.Port)), "-raw-dir", rawDir)
+		ports = append(ports, corev1.ContainerPort{
+			Name:          "raw",
+			ContainerPort: raw.Port,
+		})
+	}
+	args = append(args, retentionArgs(dataEndpoint.Spec.Retention)...)
+	if exposure := dataEndpoint.Spec.Exposure; exposure != nil && exposure.TokenSecretName != "" {
+		args = append(args, "-http-token-file", path.Join(tokenMountPath, tokenSecretKey))
+	}
+	args = append(args, dataEndpoint.Spec.ExtraArgs...)
+
+	image := dataEndpoint.Spec.Image
+	if image == "" {
+		image = dataEndpointImage
+	}
+
+	// The server only receives streams and writes files, it needs no privileges.
+	securityContext := dataEndpoint.Spec.SecurityContext
+	if securityContext == nil {
+		allowPrivilegeEscalation := false
+		securityContext = &corev1.SecurityContext{
+			AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+			},
+			SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+		}
+	}
+
+	// The data volume is writable through the group, whoever owns the claim.
+	podSecurityContext := dataEndpoint.Spec.PodSecurityContext
+	if podSecurityContext == nil {
+		runAsNonRoot := true
+		userID := int64(endpointUserID)
+		podSecurityContext = &corev1.PodSecurityContext{
+			RunAsNonRoot: &runAsNonRoot,
+			RunAsUser:    &userID,
+			RunAsGroup:   &userID,
+			FSGroup:      &userID,
+		}
+	}
+
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: objectMeta.Labels,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:            "snoopy-data",
+				Image:           image,
+				ImagePullPolicy: dataEndpoint.Spec.ImagePullPolicy,
+				Command:         []string{"/server"},
+				Args:            args,
+				Env:             dataEndpoint.Spec.Env,
+				Resources:       dataEndpoint.Spec.Resources,
+				SecurityContext: securityContext,
+				Ports:           ports,
+			}},
+			SecurityContext: podSecurityContext,
+			NodeSelector:    dataEndpoint.Spec.NodeSelector,
+			Affinity:        dataEndpoint.Spec.Affinity,
+			Tolerations:     dataEndpoint.Spec.Tolerations,
+		},
+	}
+
+	// The operator service account only exists in the operator namespace,
+	// endpoints elsewhere run with the default one of their namespace.
+	if objectMeta.Namespace == operatorNamespace {
+		template.Spec.ServiceAccountName = serviceAccountName
+	}
+
+	template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{
+		Name:      dataVolumeName,
+		MountPath: captureDir,
+	}}
+
+	// Without storage the captures still go to a volume, the capture
+	// directory of the image belongs to root.
+	storage := dataEndpoint.Spec.Storage
+	if storage == nil {
+		template.Spec.Volumes = []corev1.Volume{{
+			Name:         dataVolumeName,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		}}
+	} else if storage.ClaimName != "" {
+		template.Spec.Volumes = []corev1.Volume{{
+			Name: dataVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: storage.ClaimName},
+			},
+		}}
+	}
+
+	// The HTTP API of an exposed endpoint takes the bearer token of its Secret.
+	if exposure := dataEndpoint.Spec.Exposure; exposure != nil && exposure.TokenSecretName != "" {
+		template.Spec.Containers[0].VolumeMounts = append(template.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      tokenVolumeName,
+			MountPath: tokenMountPath,
+			ReadOnly:  true,
+		})
+		template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+			Name: tokenVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: exposure.TokenSecretName,
+					Items:      []corev1.KeyToPath{{Key: tokenSecretKey, Path: tokenSecretKey}},
+				},
+			},
+		})
+	}
+
+	return template
+}
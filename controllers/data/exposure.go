@@ -0,0 +1,121 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"log"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	datav1alpha1 "github.com/fennec-project/snoopy-operator/apis/data/v1alpha1"
+)
+
+// routeGVK is the OpenShift Route, handled as unstructured so the operator
+// does not depend on the OpenShift API.
+var routeGVK = schema.GroupVersionKind{Group: "route.openshift.io", Version: "v1", Kind: "Route"}
+
+func (r *SnoopyDataEndpointReconciler) ingressForDataEndpoint(dataEndpoint *datav1alpha1.SnoopyDataEndpoint, objectMeta metav1.ObjectMeta) client.Object {
+
+	exposure := dataEndpoint.Spec.Exposure.Ingress
+	pathType := networkingv1.PathTypePrefix
+
+	objectMeta.Annotations = exposure.Annotations
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: objectMeta,
+		Spec: networkingv1.IngressSpec{
+			IngressClassName: exposure.IngressClassName,
+			Rules: []networkingv1.IngressRule{{
+				Host: exposure.Host,
+				IngressRuleValue: networkingv1.IngressRuleValue{
+					HTTP: &networkingv1.HTTPIngressRuleValue{
+						Paths: []networkingv1.HTTPIngressPath{{
+							Path:     "/",
+							PathType: &pathType,
+							Backend: networkingv1.IngressBackend{
+								Service: &networkingv1.IngressServiceBackend{
+									Name: serviceName(dataEndpoint),
+									Port: networkingv1.ServiceBackendPort{Name: "http"},
+								},
+							},
+						}},
+					},
+				},
+			}},
+		},
+	}
+
+	if exposure.TLSSecretName != "" {
+		ingress.Spec.TLS = []networkingv1.IngressTLS{{
+			Hosts:      []string{exposure.Host},
+			SecretName: exposure.TLSSecretName,
+		}}
+	}
+
+	// Set dataEndpoint instance as the owner and controller.
+	if err := controllerutil.SetControllerReference(dataEndpoint, ingress, r.Scheme); err != nil {
+		log.Fatal(err)
+	}
+
+	return ingress
+}
+
+func (r *SnoopyDataEndpointReconciler) routeForDataEndpoint(dataEndpoint *datav1alpha1.SnoopyDataEndpoint, objectMeta metav1.ObjectMeta) client.Object {
+
+	exposure := dataEndpoint.Spec.Exposure.Route
+
+	spec := map[string]interface{}{
+		"to": map[string]interface{}{
+			"kind": "Service",
+			"name": serviceName(dataEndpoint),
+		},
+		"port": map[string]interface{}{
+			"targetPort": "http",
+		},
+	}
+	if exposure.Host != "" {
+		spec["host"] = exposure.Host
+	}
+	if exposure.TLSTermination != "" {
+		spec["tls"] = map[string]interface{}{
+			"termination":                   exposure.TLSTermination,
+			"insecureEdgeTerminationPolicy": "Redirect",
+		}
+	}
+
+	route := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	route.SetGroupVersionKind(routeGVK)
+	route.SetName(objectMeta.Name)
+	route.SetNamespace(objectMeta.Namespace)
+	route.SetLabels(objectMeta.Labels)
+
+	// Set dataEndpoint instance as the owner and controller.
+	if err := controllerutil.SetControllerReference(dataEndpoint, route, r.Scheme); err != nil {
+		log.Fatal(err)
+	}
+
+	return route
+}
+
+// newRoute returns an empty Route to look up or delete.
+func newRoute() *unstructured.Unstructured {
+	route := &unstructured.Unstructured{}
+	route.SetGroupVersionKind(routeGVK)
+	return route
+}
@@ -0,0 +1,99 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	datav1alpha1 "github.com/fennec-project/snoopy-operator/apis/data/v1alpha1"
+)
+
+// The ingest statistics of each SnoopyDataEndpoint are exported along with
+// the metrics of the manager, as last collected from its Pods.
+var (
+	endpointLabelNames = []string{"namespace", "name"}
+
+	activeStreamsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "snoopy_data_endpoint_active_streams",
+		Help: "Number of streams a SnoopyDataEndpoint is receiving.",
+	}, endpointLabelNames)
+
+	receivedBytesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "snoopy_data_endpoint_received_bytes",
+		Help: "Bytes received by the servers of a SnoopyDataEndpoint since they started.",
+	}, endpointLabelNames)
+
+	storageUsedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "snoopy_data_endpoint_storage_used_bytes",
+		Help: "Space used by the captures of a SnoopyDataEndpoint.",
+	}, endpointLabelNames)
+
+	prunedFilesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "snoopy_data_endpoint_pruned_files",
+		Help: "Capture files removed by the retention policy of a SnoopyDataEndpoint since its servers started.",
+	}, endpointLabelNames)
+
+	prunedBytesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "snoopy_data_endpoint_pruned_bytes",
+		Help: "Size of the capture files removed by the retention policy of a SnoopyDataEndpoint since its servers started.",
+	}, endpointLabelNames)
+
+	lastPruneGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "snoopy_data_endpoint_last_prune_timestamp_seconds",
+		Help: "When capture files of a SnoopyDataEndpoint were last removed by its retention policy.",
+	}, endpointLabelNames)
+
+	endpointGauges = []*prometheus.GaugeVec{
+		activeStreamsGauge, receivedBytesGauge, storageUsedGauge,
+		prunedFilesGauge, prunedBytesGauge, lastPruneGauge,
+	}
+)
+
+func init() {
+	for _, gauge := range endpointGauges {
+		metrics.Registry.MustRegister(gauge)
+	}
+}
+
+// recordIngestMetrics exports the ingest statistics of a SnoopyDataEndpoint,
+// dropping them when none could be collected.
+func recordIngestMetrics(dataEndpoint *datav1alpha1.SnoopyDataEndpoint, ingest *datav1alpha1.IngestStats) {
+
+	if ingest == nil {
+		deleteIngestMetrics(dataEndpoint.Namespace, dataEndpoint.Name)
+		return
+	}
+
+	labels := prometheus.Labels{"namespace": dataEndpoint.Namespace, "name": dataEndpoint.Name}
+	activeStreamsGauge.With(labels).Set(float64(ingest.ActiveStreams))
+	receivedBytesGauge.With(labels).Set(float64(ingest.BytesReceived))
+	if ingest.StorageUsed != nil {
+		storageUsedGauge.With(labels).Set(float64(ingest.StorageUsed.Value()))
+	}
+	prunedFilesGauge.With(labels).Set(float64(ingest.PrunedFiles))
+	prunedBytesGauge.With(labels).Set(float64(ingest.PrunedBytes))
+	if ingest.LastPruneTime != nil {
+		lastPruneGauge.With(labels).Set(float64(ingest.LastPruneTime.Unix()))
+	}
+}
+
+// deleteIngestMetrics drops the exported statistics of a SnoopyDataEndpoint.
+func deleteIngestMetrics(namespace string, name string) {
+	labels := prometheus.Labels{"namespace": namespace, "name": name}
+	for _, gauge := range endpointGauges {
+		gauge.Delete(labels)
+	}
+}
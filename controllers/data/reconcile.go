@@ -17,10 +17,12 @@ package data
 import (
 	"context"
 
+	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	datav1alpha1 "github.com/fennec-project/snoopy-operator/apis/data/v1alpha1"
@@ -37,34 +39,64 @@ func setObjectMeta(name string, namespace string, labels map[string]string) meta
 	return objectMeta
 }
 
+// reconcileResource applies the resource built by createResource with
+// server-side apply, the operator owning the fields it sets. Missing resources
+// are created, spec changes rolled out and manual edits of those fields reverted.
 func (r *SnoopyDataEndpointReconciler) reconcileResource(ctx context.Context,
 	createResource createResourceFunc,
 	dataEndpoint *datav1alpha1.SnoopyDataEndpoint,
-	resource client.Object,
 	objectMeta metav1.ObjectMeta) error {
 
 	Log := log.FromContext(ctx).WithValues("method", "reconcileResource")
 
-	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: objectMeta.Name, Namespace: objectMeta.Namespace}, resource)
+	resource := createResource(dataEndpoint, objectMeta)
+	gvk, err := apiutil.GVKForObject(resource, r.Scheme)
 	if err != nil {
-		if errors.IsNotFound(err) {
+		return err
+	}
+	resource.GetObjectKind().SetGroupVersionKind(gvk)
 
-			// Define a new resource
-			Log.Info("Creating a new resource for Snoopy Data Endpoint")
+	err = r.Client.Patch(ctx, resource, client.Apply, client.FieldOwner(fieldOwner), client.ForceOwnership)
+	if err != nil {
+		// The claim templates of a StatefulSet can't change. It is recreated
+		// on the next reconcile, leaving its Pods and claims in place.
+		if _, ok := resource.(*appsv1.StatefulSet); ok && errors.IsInvalid(err) {
+			Log.Info("Recreating resource for Snoopy Data Endpoint", "resource", resource.GetName())
+			if deleteErr := r.Client.Delete(ctx, resource, client.PropagationPolicy(metav1.DeletePropagationOrphan)); deleteErr != nil && !errors.IsNotFound(deleteErr) {
+				return deleteErr
+			}
+		}
+		Log.Error(err, "Failed to apply resource", "resource", resource.GetName())
+		return err
+	}
+
+	Log.V(2).Info("Resource applied successfully", "resource", resource.GetName())
+	return nil
+}
 
-			resource := createResource(dataEndpoint, objectMeta)
-			err = r.Client.Create(context.TODO(), resource)
+// deleteOwnedResource deletes a resource of the SnoopyDataEndpoint that is no
+// longer wanted, such as the Deployment it used before it got storage.
+func (r *SnoopyDataEndpointReconciler) deleteOwnedResource(ctx context.Context,
+	dataEndpoint *datav1alpha1.SnoopyDataEndpoint,
+	resource client.Object,
+	objectMeta metav1.ObjectMeta) error {
 
-			if err != nil {
-				Log.Error(err, "Failed to create new resource")
-				return err
-			}
+	Log := log.FromContext(ctx).WithValues("method", "deleteOwnedResource")
 
-			Log.Info("Resource created successfully", "resource", resource.GetName())
+	err := r.Client.Get(ctx, types.NamespacedName{Name: objectMeta.Name, Namespace: objectMeta.Namespace}, resource)
+	if err != nil {
+		if errors.IsNotFound(err) {
 			return nil
 		}
+		return err
+	}
+
+	if !metav1.IsControlledBy(resource, dataEndpoint) {
+		return nil
+	}
 
-		Log.Error(err, "Error reading resource", "resource", resource.GetName())
+	Log.Info("Deleting resource no longer used by Snoopy Data Endpoint", "resource", resource.GetName())
+	if err := r.Client.Delete(ctx, resource); err != nil && !errors.IsNotFound(err) {
 		return err
 	}
 
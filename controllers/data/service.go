@@ -33,17 +33,100 @@ func (r *SnoopyDataEndpointReconciler) serviceForDataEndpoint(dataEndpoint *data
 		ObjectMeta: objectMeta,
 		Spec: corev1.ServiceSpec{
 			Ports: []corev1.ServicePort{
-				{Name: dataEndpoint.Spec.ServiceName,
+				{Name: "grpc",
 					Protocol:   "TCP",
 					Port:       dataEndpoint.Spec.ServicePort,
-					TargetPort: intstr.FromInt(51001)},
+					TargetPort: intstr.FromInt(int(endpointPort(dataEndpoint)))},
 			},
 			Selector: objectMeta.Labels,
 		},
 	}
+	service.Spec.Ports = append(service.Spec.Ports, httpServicePort(dataEndpoint))
+	service.Spec.Ports = append(service.Spec.Ports, rawServicePorts(dataEndpoint)...)
+
+	// Set dataEndpoint instance as the owner and controller.
+	if err := controllerutil.SetControllerReference(dataEndpoint, service, r.Scheme); err != nil {
+		log.Fatal(err)
+	}
+	return service
+}
+
+// externalServiceForDataEndpoint publishes the HTTP API of a SnoopyDataEndpoint
+// on a NodePort or LoadBalancer service. Streams are only taken in the cluster.
+func (r *SnoopyDataEndpointReconciler) externalServiceForDataEndpoint(dataEndpoint *datav1alpha1.SnoopyDataEndpoint, objectMeta metav1.ObjectMeta) client.Object {
+
+	exposure := dataEndpoint.Spec.Exposure
+
+	objectMeta.Annotations = exposure.ServiceAnnotations
+	service := &corev1.Service{
+		ObjectMeta: objectMeta,
+		Spec: corev1.ServiceSpec{
+			Type:     exposure.Type,
+			Ports:    []corev1.ServicePort{httpServicePort(dataEndpoint)},
+			Selector: objectMeta.Labels,
+		},
+	}
+	if exposure.Type == corev1.ServiceTypeLoadBalancer {
+		service.Spec.LoadBalancerSourceRanges = exposure.LoadBalancerSourceRanges
+	}
+
+	// Set dataEndpoint instance as the owner and controller.
+	if err := controllerutil.SetControllerReference(dataEndpoint, service, r.Scheme); err != nil {
+		log.Fatal(err)
+	}
+	return service
+}
+
+// headlessServiceForDataEndpoint gives each endpoint Pod of a StatefulSet a
+// stable DNS name, <pod>.<service>.<namespace>.svc, for workers to stream
+// to the replica holding the captures of their target.
+func (r *SnoopyDataEndpointReconciler) headlessServiceForDataEndpoint(dataEndpoint *datav1alpha1.SnoopyDataEndpoint, objectMeta metav1.ObjectMeta) client.Object {
+
+	service := &corev1.Service{
+		ObjectMeta: objectMeta,
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Ports: []corev1.ServicePort{
+				{Name: "grpc",
+					Protocol:   "TCP",
+					Port:       endpointPort(dataEndpoint),
+					TargetPort: intstr.FromInt(int(endpointPort(dataEndpoint)))},
+			},
+			Selector: objectMeta.Labels,
+		},
+	}
+	service.Spec.Ports = append(service.Spec.Ports, httpServicePort(dataEndpoint))
+	service.Spec.Ports = append(service.Spec.Ports, rawServicePorts(dataEndpoint)...)
+
 	// Set dataEndpoint instance as the owner and controller.
 	if err := controllerutil.SetControllerReference(dataEndpoint, service, r.Scheme); err != nil {
 		log.Fatal(err)
 	}
 	return service
 }
+
+// rawServicePorts exposes the raw receiver of a SnoopyDataEndpoint, if any.
+func rawServicePorts(dataEndpoint *datav1alpha1.SnoopyDataEndpoint) []corev1.ServicePort {
+
+	raw := dataEndpoint.Spec.RawReceiver
+	if raw == nil {
+		return nil
+	}
+
+	return []corev1.ServicePort{{
+		Name:       "raw",
+		Protocol:   "TCP",
+		Port:       raw.Port,
+		TargetPort: intstr.FromInt(int(raw.Port)),
+	}}
+}
+
+// httpServicePort exposes the HTTP API of a SnoopyDataEndpoint.
+func httpServicePort(dataEndpoint *datav1alpha1.SnoopyDataEndpoint) corev1.ServicePort {
+	return corev1.ServicePort{
+		Name:       "http",
+		Protocol:   "TCP",
+		Port:       endpointHTTPPort(dataEndpoint),
+		TargetPort: intstr.FromInt(int(endpointHTTPPort(dataEndpoint))),
+	}
+}
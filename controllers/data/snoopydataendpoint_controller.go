@@ -19,11 +19,14 @@ import (
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	datav1alpha1 "github.com/fennec-project/snoopy-operator/apis/data/v1alpha1"
@@ -33,14 +36,20 @@ import (
 type SnoopyDataEndpointReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// routesAvailable is set where the OpenShift Route API is served.
+	routesAvailable bool
 }
 
 //+kubebuilder:rbac:groups=data.fennecproject.io,resources=snoopydataendpoints,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=data.fennecproject.io,resources=snoopydataendpoints/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=data.fennecproject.io,resources=snoopydataendpoints/finalizers,verbs=update
 //+kubebuilder:rbac:groups=core,resources=services;configmaps,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims;pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=route.openshift.io,resources=routes;routes/custom-host,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -66,40 +75,189 @@ func (r *SnoopyDataEndpointReconciler) Reconcile(ctx context.Context, req ctrl.R
 			// Request object not found, could have been deleted after reconcile request.
 			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
 			// Return and don't requeue
-
+			deleteIngestMetrics(req.Namespace, req.Name)
 			return reconcile.Result{}, nil
 		}
 		Log.Error(err, "Error requesting DataEndpoint")
 		return ctrl.Result{Requeue: true}, err
 	}
 
-	// Reconcile Deployment for SnoopyDataEndpoint
-	deploymentForDataEndpoint := &appsv1.Deployment{}
-	objectMeta := setObjectMeta("snoopy-data", "snoopy-operator", map[string]string{"app": "snoopy-data"})
-	err = r.reconcileResource(ctx, r.deploymentForDataEndpoint, DataEndpoint, deploymentForDataEndpoint, objectMeta)
+	// Nothing is deployed for a SnoopyDataEndpoint that couldn't work.
+	if message := invalidSpec(DataEndpoint); message != "" {
+		Log.Info("Invalid SnoopyDataEndpoint", "message", message)
+		if err = r.rejectSpec(ctx, DataEndpoint, message); err != nil {
+			Log.Error(err, "Error updating status for SnoopyDataEndpoint...")
+			return reconcile.Result{Requeue: true}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// Reconcile Deployment or StatefulSet for SnoopyDataEndpoint, dropping the
+	// other one when the storage changed.
+	objectMeta := setObjectMeta(DataEndpoint.Name, DataEndpoint.Namespace, endpointLabels(DataEndpoint))
+	if usesStatefulSet(DataEndpoint) {
+		err = r.reconcileResource(ctx, r.statefulSetForDataEndpoint, DataEndpoint, objectMeta)
+		if err == nil {
+			err = r.deleteOwnedResource(ctx, DataEndpoint, &appsv1.Deployment{}, objectMeta)
+		}
+	} else {
+		err = r.reconcileResource(ctx, r.deploymentForDataEndpoint, DataEndpoint, objectMeta)
+		if err == nil {
+			err = r.deleteOwnedResource(ctx, DataEndpoint, &appsv1.StatefulSet{}, objectMeta)
+		}
+	}
 	if err != nil {
-		Log.Error(err, "Error reconciling deployment for SnoopyDataEndpoint...")
+		Log.Error(err, "Error reconciling workload for SnoopyDataEndpoint...")
 		return reconcile.Result{Requeue: true}, err
 	}
 
 	// Reconcile Service for SnoopyDataEndpoint
-	svcForDataEndpoint := &corev1.Service{}
-	objectMeta = setObjectMeta("snoopy-data-svc", "snoopy-operator", map[string]string{"app": "snoopy-data"})
-	err = r.reconcileResource(ctx, r.serviceForDataEndpoint, DataEndpoint, svcForDataEndpoint, objectMeta)
+	objectMeta = setObjectMeta(serviceName(DataEndpoint), DataEndpoint.Namespace, endpointLabels(DataEndpoint))
+	err = r.reconcileResource(ctx, r.serviceForDataEndpoint, DataEndpoint, objectMeta)
 	if err != nil {
-		Log.Error(err, "Error reconciling deployment for SnoopyDataEndpoint...")
+		Log.Error(err, "Error reconciling service for SnoopyDataEndpoint...")
+		return reconcile.Result{Requeue: true}, err
+	}
+
+	// Reconcile headless Service naming the Pods of the StatefulSet
+	objectMeta = setObjectMeta(headlessServiceName(DataEndpoint), DataEndpoint.Namespace, endpointLabels(DataEndpoint))
+	if usesStatefulSet(DataEndpoint) {
+		err = r.reconcileResource(ctx, r.headlessServiceForDataEndpoint, DataEndpoint, objectMeta)
+	} else {
+		err = r.deleteOwnedResource(ctx, DataEndpoint, &corev1.Service{}, objectMeta)
+	}
+	if err != nil {
+		Log.Error(err, "Error reconciling headless service for SnoopyDataEndpoint...")
+		return reconcile.Result{Requeue: true}, err
+	}
+
+	// Reconcile external Service, Ingress and Route exposing the HTTP API
+	if err = r.reconcileExposure(ctx, DataEndpoint); err != nil {
+		Log.Error(err, "Error reconciling exposure for SnoopyDataEndpoint...")
+		return reconcile.Result{Requeue: true}, err
+	}
+
+	// The ingest statistics are collected again as streams come and go.
+	if err = r.reconcileStatus(ctx, DataEndpoint); err != nil {
+		Log.Error(err, "Error updating status for SnoopyDataEndpoint...")
 		return reconcile.Result{Requeue: true}, err
 	}
 
 	Log.V(2).Info("Reconciliation done successfully")
-	return ctrl.Result{}, nil
+	return ctrl.Result{RequeueAfter: statsPollInterval}, nil
+}
+
+// serviceName returns the name of the Service of a SnoopyDataEndpoint,
+// ServiceName or else the name of the SnoopyDataEndpoint itself.
+func serviceName(dataEndpoint *datav1alpha1.SnoopyDataEndpoint) string {
+	if dataEndpoint.Spec.ServiceName != "" {
+		return dataEndpoint.Spec.ServiceName
+	}
+	return dataEndpoint.Name
+}
+
+// externalServiceName returns the name of the Service publishing the HTTP
+// API of a SnoopyDataEndpoint on a NodePort or a load balancer.
+func externalServiceName(dataEndpoint *datav1alpha1.SnoopyDataEndpoint) string {
+	return serviceName(dataEndpoint) + "-external"
+}
+
+// headlessServiceName returns the name of the headless Service naming the
+// Pods of the StatefulSet of a SnoopyDataEndpoint.
+func headlessServiceName(dataEndpoint *datav1alpha1.SnoopyDataEndpoint) string {
+	return serviceName(dataEndpoint) + "-headless"
+}
+
+// endpointReplicas returns the number of endpoint Pods of a SnoopyDataEndpoint.
+// It is always set so that scaling the workload by hand is reverted.
+func endpointReplicas(dataEndpoint *datav1alpha1.SnoopyDataEndpoint) *int32 {
+	replicas := int32(1)
+	if dataEndpoint.Spec.Replicas != nil && *dataEndpoint.Spec.Replicas > 1 {
+		replicas = *dataEndpoint.Spec.Replicas
+	}
+	return &replicas
+}
+
+// endpointPort returns the port the endpoint server of a SnoopyDataEndpoint listens on.
+func endpointPort(dataEndpoint *datav1alpha1.SnoopyDataEndpoint) int32 {
+	if dataEndpoint.Spec.Port != 0 {
+		return dataEndpoint.Spec.Port
+	}
+	return dataEndpointPort
+}
+
+// endpointHTTPPort returns the port the HTTP API of a SnoopyDataEndpoint listens on.
+func endpointHTTPPort(dataEndpoint *datav1alpha1.SnoopyDataEndpoint) int32 {
+	if dataEndpoint.Spec.HTTPPort != 0 {
+		return dataEndpoint.Spec.HTTPPort
+	}
+	return dataEndpointHTTPPort
+}
+
+// endpointLabels are the labels of the objects of a SnoopyDataEndpoint,
+// also selecting its Pods.
+func endpointLabels(dataEndpoint *datav1alpha1.SnoopyDataEndpoint) map[string]string {
+	return map[string]string{
+		"app":             "snoopy-data",
+		dataEndpointLabel: dataEndpoint.Name,
+	}
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *SnoopyDataEndpointReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&datav1alpha1.SnoopyDataEndpoint{}).
+
+	_, err := mgr.GetRESTMapper().RESTMapping(routeGVK.GroupKind(), routeGVK.Version)
+	r.routesAvailable = err == nil
+
+	// Status updates don't trigger a reconciliation, the ingest statistics
+	// are refreshed every statsPollInterval.
+	controller := ctrl.NewControllerManagedBy(mgr).
+		For(&datav1alpha1.SnoopyDataEndpoint{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
 		Owns(&corev1.Service{}).
 		Owns(&appsv1.Deployment{}).
-		Complete(r)
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&networkingv1.Ingress{})
+	if r.routesAvailable {
+		controller = controller.Owns(newRoute())
+	}
+
+	return controller.Complete(r)
+}
+
+// reconcileExposure applies the external Service, the Ingress and the Route
+// a SnoopyDataEndpoint asks for and deletes those it no longer does. Routes
+// are left out where their API is not served.
+func (r *SnoopyDataEndpointReconciler) reconcileExposure(ctx context.Context, dataEndpoint *datav1alpha1.SnoopyDataEndpoint) error {
+
+	// Nothing is exposed without authentication.
+	exposure := dataEndpoint.Spec.Exposure
+	if exposure == nil || exposure.TokenSecretName == "" {
+		exposure = &datav1alpha1.Exposure{}
+	}
+
+	objectMeta := setObjectMeta(externalServiceName(dataEndpoint), dataEndpoint.Namespace, endpointLabels(dataEndpoint))
+	var err error
+	if exposure.Type == corev1.ServiceTypeNodePort || exposure.Type == corev1.ServiceTypeLoadBalancer {
+		err = r.reconcileResource(ctx, r.externalServiceForDataEndpoint, dataEndpoint, objectMeta)
+	} else {
+		err = r.deleteOwnedResource(ctx, dataEndpoint, &corev1.Service{}, objectMeta)
+	}
+	if err != nil {
+		return err
+	}
+
+	objectMeta = setObjectMeta(dataEndpoint.Name, dataEndpoint.Namespace, endpointLabels(dataEndpoint))
+	if exposure.Ingress != nil {
+		err = r.reconcileResource(ctx, r.ingressForDataEndpoint, dataEndpoint, objectMeta)
+	} else {
+		err = r.deleteOwnedResource(ctx, dataEndpoint, &networkingv1.Ingress{}, objectMeta)
+	}
+	if err != nil || !r.routesAvailable {
+		return err
+	}
+
+	if exposure.Route != nil {
+		return r.reconcileResource(ctx, r.routeForDataEndpoint, dataEndpoint, objectMeta)
+	}
+	return r.deleteOwnedResource(ctx, dataEndpoint, newRoute(), objectMeta)
 }
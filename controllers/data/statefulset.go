@@ -0,0 +1,87 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"log"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	datav1alpha1 "github.com/fennec-project/snoopy-operator/apis/data/v1alpha1"
+)
+
+// usesStatefulSet tells whether the endpoint Pods of a SnoopyDataEndpoint
+// need a StatefulSet: for a volume of their own each, or for the stable
+// names workers stream to when there are several replicas.
+func usesStatefulSet(dataEndpoint *datav1alpha1.SnoopyDataEndpoint) bool {
+	storage := dataEndpoint.Spec.Storage
+	return (storage != nil && storage.ClaimName == "") || *endpointReplicas(dataEndpoint) > 1
+}
+
+func (r *SnoopyDataEndpointReconciler) statefulSetForDataEndpoint(dataEndpoint *datav1alpha1.SnoopyDataEndpoint, objectMeta metav1.ObjectMeta) client.Object {
+
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: objectMeta,
+		Spec: appsv1.StatefulSetSpec{
+			ServiceName: headlessServiceName(dataEndpoint),
+			Replicas:    endpointReplicas(dataEndpoint),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: objectMeta.Labels,
+			},
+			Template: podTemplateForDataEndpoint(dataEndpoint, objectMeta),
+			// Replicas are independent, there is no need to start them in order.
+			PodManagementPolicy: appsv1.ParallelPodManagement,
+		},
+	}
+
+	if storage := dataEndpoint.Spec.Storage; storage != nil && storage.ClaimName == "" {
+
+		size := resource.MustParse(defaultStorageSize)
+		if storage.Size != nil {
+			size = *storage.Size
+		}
+
+		accessModes := storage.AccessModes
+		if len(accessModes) == 0 {
+			accessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+		}
+
+		statefulSet.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   dataVolumeName,
+				Labels: objectMeta.Labels,
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes:      accessModes,
+				StorageClassName: storage.StorageClassName,
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+				},
+			},
+		}}
+	}
+
+	// Set dataEndpoint instance as the owner and controller.
+	if err := controllerutil.SetControllerReference(dataEndpoint, statefulSet, r.Scheme); err != nil {
+		log.Fatal(err)
+	}
+
+	return statefulSet
+}
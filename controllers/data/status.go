@@ -0,0 +1,415 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	datav1alpha1 "github.com/fennec-project/snoopy-operator/apis/data/v1alpha1"
+	pb "github.com/fennec-project/snoopy-operator/endpoint/proto"
+)
+
+// reconcileStatus records the address of a SnoopyDataEndpoint, the state of
+// its workload and the ingest statistics of its Pods.
+func (r *SnoopyDataEndpointReconciler) reconcileStatus(ctx context.Context, dataEndpoint *datav1alpha1.SnoopyDataEndpoint) error {
+
+	original := dataEndpoint.DeepCopy()
+	status := &dataEndpoint.Status
+
+	status.Address = net.JoinHostPort(serviceName(dataEndpoint)+"."+dataEndpoint.Namespace+".svc", strconv.Itoa(int(dataEndpoint.Spec.ServicePort)))
+	status.ReplicaAddresses = replicaAddresses(dataEndpoint)
+
+	var err error
+	if usesStatefulSet(dataEndpoint) {
+		err = r.statefulSetStatus(ctx, dataEndpoint)
+	} else {
+		err = r.deploymentStatus(ctx, dataEndpoint)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := r.exposureStatus(ctx, dataEndpoint); err != nil {
+		return err
+	}
+
+	if err := r.ingestStatus(ctx, dataEndpoint); err != nil {
+		return err
+	}
+
+	// Updating Status.
+	if equality.Semantic.DeepEqual(original.Status, dataEndpoint.Status) {
+		return nil
+	}
+	return r.Client.Status().Patch(ctx, dataEndpoint, client.MergeFrom(original))
+}
+
+// invalidSpec explains why a SnoopyDataEndpoint can't be deployed. It is
+// empty when the SnoopyDataEndpoint is valid.
+func invalidSpec(dataEndpoint *datav1alpha1.SnoopyDataEndpoint) string {
+
+	// Replicas would each prune and rotate the captures of the others, on a
+	// claim that is most often ReadWriteOnce anyway.
+	if storage := dataEndpoint.Spec.Storage; storage != nil && storage.ClaimName != "" && *endpointReplicas(dataEndpoint) > 1 {
+		return "storage.claimName can't be shared by several replicas, leave it out for a claim per replica"
+	}
+
+	if raw := dataEndpoint.Spec.RawReceiver; raw != nil {
+		if raw.Port == endpointPort(dataEndpoint) || raw.Port == endpointHTTPPort(dataEndpoint) {
+			return "rawReceiver.port must differ from the gRPC and HTTP ports of the endpoint"
+		}
+		// Anywhere else the raw streams would go to the container filesystem.
+		if raw.FilePath != "" && !inCaptureDir(raw.FilePath) {
+			return fmt.Sprintf("rawReceiver.filePath must be %v or a directory under it", captureDir)
+		}
+	}
+
+	return ""
+}
+
+// inCaptureDir tells whether dir is the capture directory, where the data
+// volume is mounted, or a directory under it.
+func inCaptureDir(dir string) bool {
+	dir = path.Clean(dir)
+	return dir == captureDir || strings.HasPrefix(dir, captureDir+"/")
+}
+
+// rejectSpec sets the Ready condition of an invalid SnoopyDataEndpoint to
+// false with the reason it is invalid.
+func (r *SnoopyDataEndpointReconciler) rejectSpec(ctx context.Context, dataEndpoint *datav1alpha1.SnoopyDataEndpoint, message string) error {
+
+	original := dataEndpoint.DeepCopy()
+
+	// Updating Status.
+	meta.SetStatusCondition(&dataEndpoint.Status.Conditions, metav1.Condition{
+		Type:               datav1alpha1.ConditionReady,
+		Status:             metav1.ConditionFalse,
+		Reason:             "InvalidSpec",
+		Message:            message,
+		ObservedGeneration: dataEndpoint.Generation,
+	})
+
+	if equality.Semantic.DeepEqual(original.Status, dataEndpoint.Status) {
+		return nil
+	}
+	return r.Client.Status().Patch(ctx, dataEndpoint, client.MergeFrom(original))
+}
+
+// replicaAddresses lists the address of each endpoint Pod of a StatefulSet
+// with several replicas, by ordinal. SnoopyJobs pick the one to stream to
+// from these.
+func replicaAddresses(dataEndpoint *datav1alpha1.SnoopyDataEndpoint) []string {
+
+	replicas := *endpointReplicas(dataEndpoint)
+	if replicas < 2 {
+		return nil
+	}
+
+	addresses := []string{}
+	for i := int32(0); i < replicas; i++ {
+		host := fmt.Sprintf("%s-%d.%s.%s.svc", dataEndpoint.Name, i, headlessServiceName(dataEndpoint), dataEndpoint.Namespace)
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(int(endpointPort(dataEndpoint)))))
+	}
+
+	return addresses
+}
+
+// deploymentStatus mirrors the replicas and the conditions of the endpoint Deployment.
+func (r *SnoopyDataEndpointReconciler) deploymentStatus(ctx context.Context, dataEndpoint *datav1alpha1.SnoopyDataEndpoint) error {
+
+	deploy := &appsv1.Deployment{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: dataEndpoint.Name, Namespace: dataEndpoint.Namespace}, deploy); err != nil {
+		if errors.IsNotFound(err) {
+			setWorkloadConditions(dataEndpoint, 0, 0, nil, nil)
+			return nil
+		}
+		return err
+	}
+
+	var available, failure *appsv1.DeploymentCondition
+	for i := range deploy.Status.Conditions {
+		condition := &deploy.Status.Conditions[i]
+		switch {
+		case condition.Type == appsv1.DeploymentAvailable:
+			available = condition
+		case condition.Type == appsv1.DeploymentReplicaFailure && condition.Status == corev1.ConditionTrue:
+			failure = condition
+		case condition.Type == appsv1.DeploymentProgressing && condition.Status == corev1.ConditionFalse:
+			failure = condition
+		}
+	}
+
+	desired := int32(1)
+	if deploy.Spec.Replicas != nil {
+		desired = *deploy.Spec.Replicas
+	}
+
+	var ready, degraded *metav1.Condition
+	if available != nil {
+		ready = &metav1.Condition{Status: metav1.ConditionStatus(available.Status), Reason: available.Reason, Message: available.Message}
+	}
+	if failure != nil {
+		degraded = &metav1.Condition{Status: metav1.ConditionTrue, Reason: failure.Reason, Message: failure.Message}
+	}
+
+	setWorkloadConditions(dataEndpoint, desired, deploy.Status.ReadyReplicas, ready, degraded)
+	return nil
+}
+
+// statefulSetStatus mirrors the replicas of the endpoint StatefulSet.
+func (r *SnoopyDataEndpointReconciler) statefulSetStatus(ctx context.Context, dataEndpoint *datav1alpha1.SnoopyDataEndpoint) error {
+
+	statefulSet := &appsv1.StatefulSet{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: dataEndpoint.Name, Namespace: dataEndpoint.Namespace}, statefulSet); err != nil {
+		if errors.IsNotFound(err) {
+			setWorkloadConditions(dataEndpoint, 0, 0, nil, nil)
+			return nil
+		}
+		return err
+	}
+
+	desired := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		desired = *statefulSet.Spec.Replicas
+	}
+
+	setWorkloadConditions(dataEndpoint, desired, statefulSet.Status.ReadyReplicas, nil, nil)
+	return nil
+}
+
+// setWorkloadConditions sets the replicas and the conditions of a
+// SnoopyDataEndpoint. The Ready and Degraded conditions of the workload are
+// used when it has any, and derived from the replicas otherwise.
+func setWorkloadConditions(dataEndpoint *datav1alpha1.SnoopyDataEndpoint, desired int32, ready int32, readyCondition *metav1.Condition, degradedCondition *metav1.Condition) {
+
+	status := &dataEndpoint.Status
+	status.Replicas = desired
+	status.ReadyReplicas = ready
+
+	if readyCondition == nil {
+		readyCondition = &metav1.Condition{Status: metav1.ConditionFalse, Reason: "NoReadyReplicas", Message: "no endpoint Pod is ready"}
+		if ready > 0 {
+			readyCondition = &metav1.Condition{Status: metav1.ConditionTrue, Reason: "ReplicasReady", Message: "endpoint Pods are ready"}
+		}
+	}
+
+	if degradedCondition == nil {
+		degradedCondition = &metav1.Condition{Status: metav1.ConditionFalse, Reason: "AllReplicasReady"}
+		if ready < desired {
+			degradedCondition = &metav1.Condition{
+				Status:  metav1.ConditionTrue,
+				Reason:  "ReplicasNotReady",
+				Message: fmt.Sprintf("%d of %d endpoint Pods are ready", ready, desired),
+			}
+		}
+	}
+
+	readyCondition.Type = datav1alpha1.ConditionReady
+	degradedCondition.Type = datav1alpha1.ConditionDegraded
+	for _, condition := range []*metav1.Condition{readyCondition, degradedCondition} {
+		condition.ObservedGeneration = dataEndpoint.Generation
+		if condition.Reason == "" {
+			condition.Reason = "Unknown"
+		}
+		meta.SetStatusCondition(&status.Conditions, *condition)
+	}
+}
+
+// exposureStatus records where a SnoopyDataEndpoint is reached from outside
+// the cluster, and whether the exposure it asks for is set up.
+func (r *SnoopyDataEndpointReconciler) exposureStatus(ctx context.Context, dataEndpoint *datav1alpha1.SnoopyDataEndpoint) error {
+
+	status := &dataEndpoint.Status
+	exposure := dataEndpoint.Spec.Exposure
+	if exposure == nil {
+		status.ExternalAddresses = nil
+		meta.RemoveStatusCondition(&status.Conditions, datav1alpha1.ConditionExposed)
+		return nil
+	}
+
+	addresses := []string{}
+	condition := metav1.Condition{
+		Type:               datav1alpha1.ConditionExposed,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Exposed",
+		ObservedGeneration: dataEndpoint.Generation,
+	}
+
+	if exposure.TokenSecretName == "" && (exposure.Type == corev1.ServiceTypeNodePort || exposure.Type == corev1.ServiceTypeLoadBalancer ||
+		exposure.Ingress != nil || exposure.Route != nil) {
+		// Updating Status.
+		status.ExternalAddresses = nil
+		condition.Status, condition.Reason, condition.Message = metav1.ConditionFalse, "AuthenticationRequired", "exposure.tokenSecretName is required to expose the HTTP API"
+		meta.SetStatusCondition(&status.Conditions, condition)
+		return nil
+	}
+
+	if exposure.Type == corev1.ServiceTypeLoadBalancer {
+		service := &corev1.Service{}
+		err := r.Client.Get(ctx, types.NamespacedName{Name: externalServiceName(dataEndpoint), Namespace: dataEndpoint.Namespace}, service)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			host := ingress.IP
+			if ingress.Hostname != "" {
+				host = ingress.Hostname
+			}
+			addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(int(endpointHTTPPort(dataEndpoint)))))
+		}
+		if len(addresses) == 0 {
+			condition.Status, condition.Reason, condition.Message = metav1.ConditionFalse, "LoadBalancerPending", "the service has no load balancer yet"
+		}
+	}
+
+	if ingress := exposure.Ingress; ingress != nil {
+		scheme := "http://"
+		if ingress.TLSSecretName != "" {
+			scheme = "https://"
+		}
+		addresses = append(addresses, scheme+ingress.Host)
+	}
+
+	if exposure.Route != nil {
+		if !r.routesAvailable {
+			condition.Status, condition.Reason, condition.Message = metav1.ConditionFalse, "RouteUnavailable", "the route.openshift.io API is not served"
+		} else {
+			route := newRoute()
+			err := r.Client.Get(ctx, types.NamespacedName{Name: dataEndpoint.Name, Namespace: dataEndpoint.Namespace}, route)
+			if err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+			// The router picks a host when none was given.
+			if host, _, _ := unstructured.NestedString(route.Object, "spec", "host"); host != "" {
+				scheme := "http://"
+				if exposure.Route.TLSTermination != "" {
+					scheme = "https://"
+				}
+				addresses = append(addresses, scheme+host)
+			}
+		}
+	}
+
+	// Updating Status.
+	status.ExternalAddresses = addresses
+	meta.SetStatusCondition(&status.Conditions, condition)
+	return nil
+}
+
+// ingestStatus sums up the statistics reported by the ready endpoint Pods.
+// Pods that can't be reached are left out.
+func (r *SnoopyDataEndpointReconciler) ingestStatus(ctx context.Context, dataEndpoint *datav1alpha1.SnoopyDataEndpoint) error {
+	Log := log.FromContext(ctx).WithValues("method", "ingestStatus")
+
+	pods := &corev1.PodList{}
+	if err := r.Client.List(ctx, pods, client.InNamespace(dataEndpoint.Namespace), client.MatchingLabels(endpointLabels(dataEndpoint))); err != nil {
+		return err
+	}
+
+	var ingest *datav1alpha1.IngestStats
+	var used, capacity int64
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.PodIP == "" || !podReady(pod) {
+			continue
+		}
+
+		stats, err := endpointStats(ctx, net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(endpointPort(dataEndpoint)))))
+		if err != nil {
+			Log.Error(err, "Error reading ingest statistics", "pod", pod.Name)
+			continue
+		}
+
+		if ingest == nil {
+			ingest = &datav1alpha1.IngestStats{}
+		}
+		ingest.ActiveStreams += stats.ActiveStreams
+		ingest.BytesReceived += stats.BytesReceived
+		used += stats.StorageUsedBytes
+		capacity += stats.StorageCapacityBytes
+		ingest.PrunedFiles += stats.PrunedFiles
+		ingest.PrunedBytes += stats.PrunedBytes
+		if stats.LastPruneTime > 0 {
+			lastPruneTime := metav1.Unix(stats.LastPruneTime, 0)
+			if ingest.LastPruneTime == nil || ingest.LastPruneTime.Before(&lastPruneTime) {
+				ingest.LastPruneTime = &lastPruneTime
+			}
+		}
+	}
+
+	if ingest != nil {
+		ingest.StorageUsed = resource.NewQuantity(used, resource.BinarySI)
+		ingest.StorageCapacity = resource.NewQuantity(capacity, resource.BinarySI)
+
+		// The update time only moves with the statistics, sparing status
+		// patches while nothing is captured.
+		previous := dataEndpoint.Status.Ingest
+		if previous != nil {
+			ingest.UpdateTime = previous.UpdateTime
+		}
+		if previous == nil || !equality.Semantic.DeepEqual(ingest, previous) {
+			ingest.UpdateTime = metav1.Now()
+		}
+	}
+
+	recordIngestMetrics(dataEndpoint, ingest)
+
+	// Updating Status.
+	dataEndpoint.Status.Ingest = ingest
+	return nil
+}
+
+// endpointStats asks the endpoint Pod at address for its ingest statistics.
+func endpointStats(ctx context.Context, address string) (*pb.StatsResponse, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, statsTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return pb.NewDataEndpointClient(conn).GetStats(ctx, &pb.StatsRequest{})
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+	pb "github.com/fennec-project/snoopy-operator/endpoint/proto"
+)
+
+// reconcileStop cancels a SnoopyJob. The data endpoint is told to finalize
+// the streams of the running workers as truncated, the workers are annotated
+// with the stop reason and their Jobs deleted, and CronJobs are suspended.
+// Results recorded so far are kept.
+func (r *SnoopyJobReconciler) reconcileStop(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob) error {
+	Log := log.FromContext(ctx).WithValues("method", "reconcileStop")
+
+	// Updating Status.
+	snoopyJob.Status.Phase = jobv1alpha1.SnoopyJobStopped
+
+	if snoopyJob.Spec.Schedule != "" {
+		cronJobs, err := r.listCronJobs(ctx, snoopyJob)
+		if err != nil {
+			return err
+		}
+		if err := r.suspendCronJobs(ctx, cronJobs, true); err != nil {
+			return err
+		}
+	}
+
+	workers, err := r.listWorkerPods(ctx, snoopyJob)
+	if err != nil {
+		return err
+	}
+
+	running := []*corev1.Pod{}
+	for i := range workers.Items {
+		pod := &workers.Items[i]
+		if pod.Annotations[stopReasonAnnotation] != "" || pod.DeletionTimestamp != nil ||
+			pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		running = append(running, pod)
+	}
+
+	// Workers are stopped all the same when the data endpoint can't be
+	// reached, their streams end as they go away.
+	if err := r.finalizeStreams(ctx, snoopyJob, running); err != nil {
+		Log.Error(err, "Error finalizing data endpoint streams of SnoopyJob")
+	}
+
+	for _, pod := range running {
+		original := pod.DeepCopy()
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[stopReasonAnnotation] = string(jobv1alpha1.StopReasonStopped)
+		if err := r.Client.Patch(ctx, pod, client.MergeFrom(original)); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	// Record the results as they stand before the workers go away.
+	reconcileStepResults(snoopyJob, workers)
+	stopOutcomes(snoopyJob, workers)
+
+	if err := r.reconcileArtifacts(ctx, snoopyJob, workers); err != nil {
+		return err
+	}
+	if outputSink(snoopyJob) == jobv1alpha1.DataEndpointSink {
+		artifacts := snoopyJob.Status.Artifacts
+		now := metav1.Now()
+		for _, pod := range running {
+			target := pod.Labels[snoopyTargetLabel]
+			artifacts = append(artifacts, jobv1alpha1.Artifact{
+				Target:         target,
+				Run:            pod.Name,
+				Sink:           jobv1alpha1.DataEndpointSink,
+				Location:       dataEndpointLocation(snoopyJob, pod),
+				CompletionTime: &now,
+				Truncated:      true,
+			})
+		}
+		// Updating Status.
+		updateArtifacts(&snoopyJob.Status, artifacts)
+	}
+
+	if err := r.deleteActiveJobs(ctx, snoopyJob); err != nil {
+		return err
+	}
+
+	return r.releaseTargets(ctx, snoopyJob)
+}
+
+// finalizeStreams asks the data endpoint to end the streams of running
+// workers and to mark them as truncated, each replica for the workers
+// streaming to it. Streams are named exactly, and narrowed down to the target
+// namespace and the SnoopyJob, so that same-named streams of other targets
+// and SnoopyJobs go on.
+func (r *SnoopyJobReconciler) finalizeStreams(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, running []*corev1.Pod) error {
+
+	if outputSink(snoopyJob) != jobv1alpha1.DataEndpointSink || len(running) == 0 {
+		return nil
+	}
+
+	names := map[string][]string{}
+	for _, pod := range running {
+		address := workerDataAddress(snoopyJob, pod)
+		names[address] = append(names[address], r.streamNames(snoopyJob, pod.Labels[snoopyTargetLabel])...)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, finalizeTimeout)
+	defer cancel()
+
+	var finalizeErr error
+	for address := range names {
+		req := &pb.FinalizeRequest{
+			Names:     names[address],
+			Reason:    string(jobv1alpha1.StopReasonStopped),
+			Namespace: snoopyJob.Spec.TargetNamespace,
+			Job:       snoopyJob.Name,
+		}
+		if err := finalizeReplicaStreams(ctx, address, req); err != nil {
+			finalizeErr = err
+		}
+	}
+
+	return finalizeErr
+}
+
+// finalizeReplicaStreams asks the data endpoint at address to end the streams req selects.
+func finalizeReplicaStreams(ctx context.Context, address string, req *pb.FinalizeRequest) error {
+
+	conn, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = pb.NewDataEndpointClient(conn).FinalizeStreams(ctx, req)
+	return err
+}
+
+// stopOutcomes settles the outcome of the targets still running or waiting
+// for their next attempt as Stopped.
+func stopOutcomes(snoopyJob *jobv1alpha1.SnoopyJob, workers *corev1.PodList) {
+
+	outcomes := append([]jobv1alpha1.TargetOutcome{}, snoopyJob.Status.Outcomes...)
+	known := map[string]bool{}
+	for _, outcome := range outcomes {
+		known[outcome.Target] = true
+	}
+
+	for i := range workers.Items {
+		pod := &workers.Items[i]
+		target := pod.Labels[snoopyTargetLabel]
+		if !known[target] {
+			known[target] = true
+			outcomes = append(outcomes, jobv1alpha1.TargetOutcome{Target: target, Outcome: jobv1alpha1.TargetRunning, Attempts: podAttempt(pod)})
+		}
+	}
+
+	for i := range outcomes {
+		if outcomes[i].Outcome == jobv1alpha1.TargetRunning || outcomes[i].Outcome == jobv1alpha1.TargetRetrying {
+			outcomes[i].Outcome = jobv1alpha1.TargetStopped
+			outcomes[i].NextAttemptTime = nil
+			outcomes[i].Message = "SnoopyJob stopped"
+		}
+	}
+
+	// Updating Status.
+	snoopyJob.Status.Outcomes = outcomes
+	snoopyJob.Status.TargetCounts = countOutcomes(outcomes)
+}
+
+// deleteActiveJobs deletes the unfinished Jobs of a SnoopyJob, waiting for
+// their worker Pods to go away first.
+func (r *SnoopyJobReconciler) deleteActiveJobs(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob) error {
+
+	jobs, err := r.listJobs(ctx, snoopyJob)
+	if err != nil {
+		return err
+	}
+
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if job.DeletionTimestamp != nil || jobFinished(job) {
+			continue
+		}
+		if err := r.Client.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationForeground)); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// jobFinished tells whether a Job completed or failed.
+func jobFinished(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) && condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
@@ -14,7 +14,109 @@
 
 package job
 
+import "time"
+
 const (
 	serviceAccountName = "snoopy-operator-sa"
-	podtracerImage     = "quay.io/fennec-project/podtracer:0.0.1-14"
+
+	// defaultPodtracerImage is the podtracer image workers run unless told otherwise.
+	defaultPodtracerImage = "quay.io/fennec-project/podtracer:0.0.1-14"
+
+	// Labels set on worker Pods to find them back from a SnoopyJob. Workers
+	// of SnoopyJobs in all namespaces share the snoopy-operator namespace, so
+	// they are told apart by the namespace of their SnoopyJob as well.
+	snoopyJobLabel          = "snoopyJobName"
+	snoopyJobNamespaceLabel = "snoopyJobNamespace"
+	snoopyTargetLabel       = "snoopyJobTarget"
+
+	// leaseFinalizer keeps a SnoopyJob around until the Leases of its targets
+	// are deleted. They can't be owned by a SnoopyJob in another namespace.
+	leaseFinalizer = "job.fennecproject.io/leases"
+
+	// defaultStepName names the single step of a SnoopyJob without steps.
+	defaultStepName = "podtracer"
+
+	// Volume where the PersistentVolumeClaim output sink is mounted.
+	outputVolumeName = "snoopy-output"
+	outputMountPath  = "/snoopy-output"
+
+	// outputDirAnnotation records the target directory on the PersistentVolumeClaim output sink.
+	outputDirAnnotation = "snoopyJobOutputDir"
+
+	// ConfigMap output sink size limits, leaving room under the 1Mi object limit.
+	defaultConfigMapOutputSize = 512 * 1024
+	maxConfigMapOutputSize     = 1000 * 1024
+
+	// outputTruncatedAnnotation marks output ConfigMaps holding truncated output.
+	outputTruncatedAnnotation = "snoopyOutputTruncated"
+
+	// maxArtifactsPerTarget is how many runs are kept in the status artifacts of a target.
+	maxArtifactsPerTarget = 10
+
+	// stepResultsPollInterval is how often step results are refreshed while steps run.
+	stepResultsPollInterval = 10 * time.Second
+
+	// snoopyAttemptLabel numbers the attempts of the run of a target.
+	snoopyAttemptLabel = "snoopyJobAttempt"
+
+	// defaultRetryBackoff is the delay before the second attempt of a failed run.
+	defaultRetryBackoff = 10 * time.Second
+
+	// outcomeLogLines is how many lines of step output exit code rules match against.
+	outcomeLogLines = 80
+
+	// specHashAnnotation fingerprints the spec a child was last applied with.
+	specHashAnnotation = "snoopySpecHash"
+
+	// fieldOwner is the field manager of the children applied by the operator.
+	fieldOwner = "snoopy-operator"
+
+	// stopReasonAnnotation records on a worker Pod why the operator stopped it.
+	stopReasonAnnotation = "snoopyStopReason"
+
+	// probesAnnotation maps the steps of a connectivity check SnoopyJob to
+	// the destinations they probe.
+	probesAnnotation = "snoopyConnectivityProbes"
+
+	// probeResolvePeriod is how often connectivity check destinations are resolved again.
+	probeResolvePeriod = time.Minute
+
+	// probeOutputPrefix marks the curl lines read by connectivity checks.
+	probeOutputPrefix = "snoopy-probe="
+
+	// Synchronized start: the shared start time is set on each worker Pod
+	// as an annotation and reaches the first step through a downward API volume.
+	startAtAnnotation = "snoopyStartAt"
+	startVolumeName   = "snoopy-start"
+	startMountPath    = "/snoopy-start"
+
+	// startedAtPrefix marks the log line where a synchronized worker reports when it started.
+	startedAtPrefix = "snoopy-started-at="
+
+	// startedAtAnnotation keeps on a synchronized worker Pod when it reported it started.
+	startedAtAnnotation = "snoopyStartedAt"
+
+	// Synchronized start defaults, see SynchronizedStart.
+	defaultStartLead    = 10 * time.Second
+	defaultStartTimeout = 5 * time.Minute
+
+	// startPollInterval is how often workers are checked while waiting for a synchronized start.
+	startPollInterval = 2 * time.Second
+
+	// dataAddressAnnotation records on a worker Pod the data endpoint replica it streams to.
+	dataAddressAnnotation = "snoopyDataAddress"
+
+	// maxStatusEntries bounds the per-target lists of the SnoopyJob status,
+	// keeping it far below the object size limit with thousands of targets.
+	maxStatusEntries = 100
+
+	// Worker names longer than these are shortened, see workerName. The
+	// controller labels the Pods of a Job with its name, which has to fit in a
+	// label value, and names the Jobs of a CronJob after it with an 11
+	// character suffix.
+	maxJobNameLength     = 63
+	maxCronJobNameLength = 52
+
+	// finalizeTimeout bounds the call finalizing data endpoint streams when a SnoopyJob is stopped.
+	finalizeTimeout = 10 * time.Second
 )
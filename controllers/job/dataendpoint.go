@@ -0,0 +1,108 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	datav1alpha1 "github.com/fennec-project/snoopy-operator/apis/data/v1alpha1"
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// A SnoopyDataEndpoint with several replicas lists the address of each of
+// its Pods in its status. Workers stream straight to the replica their target
+// name hashes to rather than through the Service, so every step and attempt
+// of a target ends up on the same replica.
+
+// dataEndpointReplicas returns the replica addresses of the SnoopyDataEndpoint
+// a SnoopyJob streams to, nil when it has a single replica or when the data
+// service is not a SnoopyDataEndpoint.
+func (r *SnoopyJobReconciler) dataEndpointReplicas(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob) ([]string, error) {
+
+	if outputSink(snoopyJob) != jobv1alpha1.DataEndpointSink {
+		return nil, nil
+	}
+
+	dataEndpoints := &datav1alpha1.SnoopyDataEndpointList{}
+	if err := r.Client.List(ctx, dataEndpoints); err != nil {
+		return nil, err
+	}
+
+	address := net.JoinHostPort(serviceHost(snoopyJob.Spec.DataServiceIP), snoopyJob.Spec.DataServicePort)
+	for _, dataEndpoint := range dataEndpoints.Items {
+		if dataEndpoint.Status.Address == address && len(dataEndpoint.Status.ReplicaAddresses) > 1 {
+			return dataEndpoint.Status.ReplicaAddresses, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// serviceHost brings the in-cluster name of a Service to the
+// <service>.<namespace>.svc form of the SnoopyDataEndpoint status.
+func serviceHost(host string) string {
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	host = strings.TrimSuffix(host, ".cluster.local")
+	if strings.Count(host, ".") == 1 {
+		host += ".svc"
+	}
+
+	return host
+}
+
+// replicaAddress picks the replica a target streams to, the one scoring
+// highest for it (rendezvous hashing). Adding or removing a replica only
+// moves the targets it wins or loses, the others keep their replica.
+func replicaAddress(replicas []string, target string) string {
+
+	picked := ""
+	best := uint64(0)
+	for _, replica := range replicas {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(replica + "/" + target))
+		if score := mix(hash.Sum64()); picked == "" || score > best {
+			picked, best = replica, score
+		}
+	}
+
+	return picked
+}
+
+// mix spreads the bits of an FNV hash, whose high bits barely change between
+// replica names differing in their last character.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// workerDataAddress returns the host:port a worker Pod streams to.
+func workerDataAddress(snoopyJob *jobv1alpha1.SnoopyJob, pod *corev1.Pod) string {
+
+	if address := pod.Annotations[dataAddressAnnotation]; address != "" {
+		return address
+	}
+
+	return net.JoinHostPort(snoopyJob.Spec.DataServiceIP, snoopyJob.Spec.DataServicePort)
+}
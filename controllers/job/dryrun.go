@@ -0,0 +1,200 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apimachinery "k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// dryRunTarget sums up what a dry run would run against a target.
+type dryRunTarget struct {
+	Name      string       `json:"name"`
+	Namespace string       `json:"namespace,omitempty"`
+	Node      string       `json:"node"`
+	Host      bool         `json:"host,omitempty"`
+	Worker    string       `json:"worker"`
+	Steps     []dryRunStep `json:"steps"`
+}
+
+// dryRunStep is a podtracer invocation of a dry run.
+type dryRunStep struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+}
+
+// reconcileDryRun renders the Jobs or CronJobs a SnoopyJob would create into
+// a ConfigMap instead of creating them.
+func (r *SnoopyJobReconciler) reconcileDryRun(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob) error {
+
+	objects := []client.Object{}
+	if snoopyJob.Spec.Schedule != "" {
+		cronJobs, err := r.buildCronJobForTargets(snoopyJob)
+		if err != nil {
+			return err
+		}
+		for i := range cronJobs.Items {
+			cronJobs.Items[i].TypeMeta = metav1.TypeMeta{APIVersion: "batch/v1", Kind: "CronJob"}
+			objects = append(objects, &cronJobs.Items[i])
+		}
+	} else {
+		jobs, err := r.buildJobForTargets(snoopyJob)
+		if err != nil {
+			return err
+		}
+		for i := range jobs.Items {
+			jobs.Items[i].TypeMeta = metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"}
+			objects = append(objects, &jobs.Items[i])
+		}
+	}
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "snoopy-dryrun-" + snoopyJob.Name,
+			Namespace:   snoopyJob.Namespace,
+			Labels:      map[string]string{snoopyJobLabel: snoopyJob.Name},
+			Annotations: map[string]string{},
+		},
+		Data: map[string]string{},
+	}
+
+	targets := []dryRunTarget{}
+	for _, object := range objects {
+		var podTemplate corev1.PodTemplateSpec
+		switch worker := object.(type) {
+		case *batchv1.Job:
+			podTemplate = worker.Spec.Template
+		case *batchv1.CronJob:
+			podTemplate = worker.Spec.JobTemplate.Spec.Template
+		}
+		targets = append(targets, summarizeDryRunTarget(snoopyJob, object.GetName(), podTemplate))
+	}
+
+	// The target summary comes first and the manifests share what is left
+	// below the ConfigMap size limit.
+	summary, truncated, err := dryRunSummary(targets, maxConfigMapOutputSize)
+	if err != nil {
+		return err
+	}
+	configMap.Data["targets.yaml"] = summary
+	size := len(summary)
+
+	for _, object := range objects {
+		manifest, err := yaml.Marshal(object)
+		if err != nil {
+			return err
+		}
+
+		size += len(manifest)
+		if size > maxConfigMapOutputSize {
+			truncated = true
+			continue
+		}
+		configMap.Data[object.GetName()+".yaml"] = string(manifest)
+	}
+	if truncated {
+		configMap.Annotations[outputTruncatedAnnotation] = "true"
+	}
+
+	if err := ctrl.SetControllerReference(snoopyJob, configMap, r.Scheme); err != nil {
+		return err
+	}
+
+	existing := &corev1.ConfigMap{}
+	err = r.Client.Get(ctx, apimachinery.NamespacedName{Namespace: configMap.Namespace, Name: configMap.Name}, existing)
+	switch {
+	case errors.IsNotFound(err):
+		err = r.Client.Create(ctx, configMap)
+	case err != nil:
+	case !equality.Semantic.DeepEqual(existing.Data, configMap.Data) || !equality.Semantic.DeepEqual(existing.Annotations, configMap.Annotations):
+		existing.Data = configMap.Data
+		existing.Annotations = configMap.Annotations
+		err = r.Client.Update(ctx, existing)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Updating Status.
+	snoopyJob.Status.DryRunConfigMap = configMap.Name
+	return nil
+}
+
+// dryRunSummary renders the targets of a dry run as a YAML list of at most
+// maxSize bytes. Targets that do not fit are left out and counted in a
+// comment at the end.
+func dryRunSummary(targets []dryRunTarget, maxSize int) (string, bool, error) {
+
+	var summary strings.Builder
+	for i, target := range targets {
+		entry, err := yaml.Marshal([]dryRunTarget{target})
+		if err != nil {
+			return "", false, err
+		}
+
+		// Room is kept for the marker as long as targets follow.
+		room := maxSize - summary.Len()
+		marker := fmt.Sprintf("# truncated, %d more targets\n", len(targets)-i)
+		if i < len(targets)-1 {
+			room -= len(marker)
+		}
+		if len(entry) > room {
+			summary.WriteString(marker)
+			return summary.String(), true, nil
+		}
+		summary.Write(entry)
+	}
+
+	if summary.Len() == 0 {
+		return "[]\n", false, nil
+	}
+	return summary.String(), false, nil
+}
+
+// summarizeDryRunTarget lists the target, the Node and the podtracer
+// arguments of each step of a worker Pod template.
+func summarizeDryRunTarget(snoopyJob *jobv1alpha1.SnoopyJob, worker string, podTemplate corev1.PodTemplateSpec) dryRunTarget {
+
+	target := dryRunTarget{
+		Name:   podTemplate.Labels[snoopyTargetLabel],
+		Node:   podTemplate.Spec.NodeName,
+		Host:   podTemplate.Spec.HostNetwork,
+		Worker: worker,
+		Steps:  []dryRunStep{},
+	}
+	if !target.Host {
+		target.Namespace = snoopyJob.Spec.TargetNamespace
+	}
+
+	containers := append(append([]corev1.Container{}, podTemplate.Spec.InitContainers...), podTemplate.Spec.Containers...)
+	for _, container := range containers {
+		target.Steps = append(target.Steps, dryRunStep{Name: container.Name, Args: container.Args})
+	}
+
+	return target
+}
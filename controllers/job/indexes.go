@@ -0,0 +1,74 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// Cache indexes, so lookups don't walk every Pod or Job of a namespace.
+const (
+	// podPhaseField indexes Pods by phase.
+	podPhaseField = "status.phase"
+	// snoopyJobField indexes workers, Jobs and CronJobs by the SnoopyJob they
+	// run for, <namespace>/<name>.
+	snoopyJobField = ".metadata.labels.snoopyJob"
+)
+
+// snoopyJobLabels are the labels of the workers, Jobs and CronJobs of a SnoopyJob.
+func snoopyJobLabels(snoopyJob *jobv1alpha1.SnoopyJob) map[string]string {
+	return map[string]string{
+		snoopyJobLabel:          snoopyJob.Name,
+		snoopyJobNamespaceLabel: snoopyJob.Namespace,
+	}
+}
+
+// snoopyJobKey is the snoopyJobField value of the children of a SnoopyJob.
+func snoopyJobKey(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+// setupIndexes registers the cache indexes used by the SnoopyJob reconciler.
+func setupIndexes(ctx context.Context, indexer client.FieldIndexer) error {
+
+	err := indexer.IndexField(ctx, &corev1.Pod{}, podPhaseField, func(object client.Object) []string {
+		return []string{string(object.(*corev1.Pod).Status.Phase)}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, object := range []client.Object{&corev1.Pod{}, &batchv1.Job{}, &batchv1.CronJob{}} {
+		err := indexer.IndexField(ctx, object, snoopyJobField, func(object client.Object) []string {
+			name, found := object.GetLabels()[snoopyJobLabel]
+			namespace, namespaced := object.GetLabels()[snoopyJobNamespaceLabel]
+			if !found || !namespaced {
+				return nil
+			}
+			return []string{snoopyJobKey(namespace, name)}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -15,14 +15,37 @@
 package job
 
 import (
+	"hash/fnv"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
 )
 
-func (r *SnoopyJobReconciler) Job(podtracerArgsList []string, targetPodName string, targetNodeName string) (*batchv1.Job, error) {
+// podtracerStep is a single podtracer invocation inside a worker Pod.
+type podtracerStep struct {
+	name            string
+	args            []string
+	continueOnError bool
+	// outputFile is where podtracer output is written, if anywhere.
+	outputFile string
+	// maxBytes and stopPattern end the step early when its output reaches
+	// the size or matches the pattern.
+	maxBytes    int64
+	stopPattern string
+	// startAtFile holds the shared start time the step waits for, if any.
+	startAtFile string
+}
 
-	jobTemplateSpec, err := r.JobTemplateSpec(podtracerArgsList, targetPodName, targetNodeName)
+func (r *SnoopyJobReconciler) Job(snoopyJob *jobv1alpha1.SnoopyJob, podtracerSteps []podtracerStep, target target) (*batchv1.Job, error) {
+
+	jobTemplateSpec, err := r.JobTemplateSpec(snoopyJob, podtracerSteps, target)
 	if err != nil {
 		return nil, err
 	}
@@ -32,10 +55,19 @@ func (r *SnoopyJobReconciler) Job(podtracerArgsList []string, targetPodName stri
 		Spec:       jobTemplateSpec.Spec,
 	}
 
+	// Stop the Job when the activation window closes.
+	if activeUntil := snoopyJob.Spec.ActiveUntil; activeUntil != nil {
+		activeDeadlineSeconds := int64(time.Until(activeUntil.Time).Seconds())
+		if activeDeadlineSeconds < 1 {
+			activeDeadlineSeconds = 1
+		}
+		job.Spec.ActiveDeadlineSeconds = &activeDeadlineSeconds
+	}
+
 	return job, nil
 }
 
-func (r *SnoopyJobReconciler) CronJob(podtracerArgsList []string, targetPodName string, targetNodeName string, schedule string) (*batchv1.CronJob, error) {
+func (r *SnoopyJobReconciler) CronJob(snoopyJob *jobv1alpha1.SnoopyJob, podtracerSteps []podtracerStep, target target, schedule string) (*batchv1.CronJob, error) {
 
 	var CronJob *batchv1.CronJob
 
@@ -46,17 +78,25 @@ func (r *SnoopyJobReconciler) CronJob(podtracerArgsList []string, targetPodName
 	var SuccessfulJobsHistoryLimit *int32
 	var FailedJobsHistoryLimit *int32
 
-	jobTemplateSpec, err := r.JobTemplateSpec(podtracerArgsList, targetPodName, targetNodeName)
+	jobTemplateSpec, err := r.JobTemplateSpec(snoopyJob, podtracerSteps, target)
 	if err != nil {
 		return nil, err
 	}
 
+	// Scheduled runs are retried by the Job controller itself.
+	if retryPolicy := snoopyJob.Spec.RetryPolicy; retryPolicy != nil {
+		backoffLimit := maxAttempts(retryPolicy) - 1
+		jobTemplateSpec.Spec.BackoffLimit = &backoffLimit
+	}
+
 	CronJob = &batchv1.CronJob{
 
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "snoopy-cronjob-" + targetPodName,
+			Name: workerName("snoopy-cronjob-"+workerBase(snoopyJob, target), "", maxCronJobNameLength),
 			Labels: map[string]string{
-				"snoopyCronJob": "SnoopyJob",
+				"snoopyCronJob":         "SnoopyJob",
+				snoopyJobLabel:          snoopyJob.Name,
+				snoopyJobNamespaceLabel: snoopyJob.Namespace,
 			},
 			Namespace: "snoopy-operator",
 		},
@@ -100,46 +140,47 @@ func (r *SnoopyJobReconciler) CronJob(podtracerArgsList []string, targetPodName
 	return CronJob, nil
 }
 
-func (r *SnoopyJobReconciler) JobTemplateSpec(podtracerArgsList []string, targetPodName string, targetNodeName string) (*batchv1.JobTemplateSpec, error) {
-	var privileged bool
+func (r *SnoopyJobReconciler) JobTemplateSpec(snoopyJob *jobv1alpha1.SnoopyJob, podtracerSteps []podtracerStep, target target) (*batchv1.JobTemplateSpec, error) {
 	var HostPathDirectory corev1.HostPathType
 	var HostPathSocket corev1.HostPathType
 
 	HostPathDirectory = "Directory"
 	HostPathSocket = "Socket"
 
-	privileged = true
+	attempt := targetAttempt(snoopyJob, target.name)
+
+	// The first step holds the worker until the shared start time.
+	if snoopyJob.Spec.SynchronizedStart != nil {
+		podtracerSteps = append([]podtracerStep{}, podtracerSteps...)
+		podtracerSteps[0].startAtFile = path.Join(startMountPath, "startAt")
+	}
+
+	// Steps run in order: all but the last one as init containers and
+	// the last one as the main container.
+	var initContainers []corev1.Container
+	for _, step := range podtracerSteps[:len(podtracerSteps)-1] {
+		initContainers = append(initContainers, r.podtracerContainer(step))
+	}
+	containers := []corev1.Container{r.podtracerContainer(podtracerSteps[len(podtracerSteps)-1])}
 
 	// TODO: improve the labeling system to identify jobs running.
 	PodTemplateSpec := corev1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:   "snoopy-worker",
-			Labels: map[string]string{"app": "go-remote"},
+			Name: "snoopy-worker",
+			Labels: map[string]string{
+				"app":                   "go-remote",
+				snoopyJobLabel:          snoopyJob.Name,
+				snoopyJobNamespaceLabel: snoopyJob.Namespace,
+				snoopyTargetLabel:       target.name,
+				snoopyAttemptLabel:      strconv.Itoa(int(attempt)),
+			},
 		},
 		Spec: corev1.PodSpec{
-			NodeName:           targetNodeName,
+			NodeName:           target.nodeName,
 			ServiceAccountName: serviceAccountName,
 			RestartPolicy:      "Never",
-			Containers: []corev1.Container{
-				{
-					Name:            "podtracer",
-					Image:           podtracerImage,
-					ImagePullPolicy: corev1.PullAlways,
-					Command:         []string{"/usr/bin/podtracer"},
-					Args:            podtracerArgsList,
-					SecurityContext: &corev1.SecurityContext{
-						Privileged: &privileged,
-					},
-					VolumeMounts: []corev1.VolumeMount{
-						{Name: "proc",
-							MountPath: "/host/proc",
-							ReadOnly:  false},
-						{Name: "crio-sock",
-							MountPath: "/var/run/crio/crio.sock",
-							ReadOnly:  false},
-					},
-				},
-			},
+			InitContainers:     initContainers,
+			Containers:         containers,
 			Volumes: []corev1.Volume{{
 				Name: "proc",
 				VolumeSource: corev1.VolumeSource{
@@ -162,15 +203,68 @@ func (r *SnoopyJobReconciler) JobTemplateSpec(podtracerArgsList []string, target
 		},
 	}
 
+	// Node targets run in the host network namespace of the Node, whatever its taints.
+	if target.host {
+		PodTemplateSpec.Spec.HostNetwork = true
+		PodTemplateSpec.Spec.DNSPolicy = corev1.DNSClusterFirstWithHostNet
+		PodTemplateSpec.Spec.Tolerations = []corev1.Toleration{{Operator: corev1.TolerationOpExists}}
+	}
+
+	if snoopyJob.Spec.SynchronizedStart != nil {
+		PodTemplateSpec.Spec.Volumes = append(PodTemplateSpec.Spec.Volumes, corev1.Volume{
+			Name: startVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				DownwardAPI: &corev1.DownwardAPIVolumeSource{
+					Items: []corev1.DownwardAPIVolumeFile{{
+						Path:     "startAt",
+						FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations['" + startAtAnnotation + "']"},
+					}},
+				},
+			},
+		})
+	}
+
+	PodTemplateSpec.ObjectMeta.Annotations = map[string]string{}
+	if target.dataAddress != "" {
+		PodTemplateSpec.ObjectMeta.Annotations[dataAddressAnnotation] = target.dataAddress
+	}
+
+	if outputSink(snoopyJob) == jobv1alpha1.PersistentVolumeClaimSink {
+		PodTemplateSpec.ObjectMeta.Annotations[outputDirAnnotation] = target.outputDir()
+		PodTemplateSpec.Spec.Volumes = append(PodTemplateSpec.Spec.Volumes, corev1.Volume{
+			Name: outputVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: snoopyJob.Spec.Output.PersistentVolumeClaim.ClaimName,
+				},
+			},
+		})
+	}
+
 	JobSpec := batchv1.JobSpec{
 		Template: PodTemplateSpec,
 	}
 
+	// Failed runs are retried by the operator, one Job per attempt.
+	if snoopyJob.Spec.RetryPolicy != nil {
+		backoffLimit := int32(0)
+		JobSpec.BackoffLimit = &backoffLimit
+	}
+
+	// Named after the SnoopyJob as well, as SnoopyJobs take turns on a target.
+	suffix := ""
+	if attempt > 1 {
+		suffix = "-" + strconv.Itoa(int(attempt))
+	}
+	jobName := workerName("snoopy-job-"+workerBase(snoopyJob, target), suffix, maxJobNameLength)
+
 	JobTemplateSpec := batchv1.JobTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "snoopy-job-" + targetPodName,
+			Name: jobName,
 			Labels: map[string]string{
-				"snoopyJob": "SnoopyJob",
+				"snoopyJob":             "SnoopyJob",
+				snoopyJobLabel:          snoopyJob.Name,
+				snoopyJobNamespaceLabel: snoopyJob.Namespace,
 			},
 			Namespace: "snoopy-operator",
 		},
@@ -179,3 +273,153 @@ func (r *SnoopyJobReconciler) JobTemplateSpec(podtracerArgsList []string, target
 
 	return &JobTemplateSpec, nil
 }
+
+// podtracerContainer builds the worker container running a podtracer step.
+func (r *SnoopyJobReconciler) podtracerContainer(step podtracerStep) corev1.Container {
+	privileged := true
+
+	container := corev1.Container{
+		Name:            step.name,
+		Image:           r.podtracerImage(),
+		ImagePullPolicy: corev1.PullAlways,
+		Command:         []string{"/usr/bin/podtracer"},
+		Args:            step.args,
+		SecurityContext: &corev1.SecurityContext{
+			Privileged: &privileged,
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "proc",
+				MountPath: "/host/proc",
+				ReadOnly:  false},
+			{Name: "crio-sock",
+				MountPath: "/var/run/crio/crio.sock",
+				ReadOnly:  false},
+		},
+	}
+
+	if step.outputFile != "" {
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      outputVolumeName,
+			MountPath: outputMountPath,
+		})
+		container.Env = append(container.Env,
+			corev1.EnvVar{Name: "POD_NAME",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+				}},
+			corev1.EnvVar{Name: "SNOOPY_OUTPUT_FILE",
+				Value: step.outputFile},
+		)
+	}
+
+	if step.maxBytes > 0 {
+		container.Env = append(container.Env, corev1.EnvVar{Name: "SNOOPY_MAX_BYTES", Value: strconv.FormatInt(step.maxBytes, 10)})
+	}
+
+	if step.stopPattern != "" {
+		container.Env = append(container.Env, corev1.EnvVar{Name: "SNOOPY_STOP_PATTERN", Value: step.stopPattern})
+	}
+
+	if step.startAtFile != "" {
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      startVolumeName,
+			MountPath: startMountPath,
+			ReadOnly:  true,
+		})
+		container.Env = append(container.Env, corev1.EnvVar{Name: "SNOOPY_START_AT_FILE", Value: step.startAtFile})
+	}
+
+	if step.continueOnError {
+		container.Env = append(container.Env, corev1.EnvVar{Name: "SNOOPY_CONTINUE_ON_ERROR", Value: "true"})
+	}
+
+	// The wrapper script is only needed when podtracer output is processed,
+	// its exit code is hidden from the kubelet or its start is held, see
+	// wrapsPodtracer.
+	if step.outputFile != "" || step.maxBytes > 0 || step.stopPattern != "" || step.continueOnError || step.startAtFile != "" {
+		container.Command = []string{"/bin/sh", "-c", podtracerWrapperScript, "podtracer"}
+	}
+
+	return container
+}
+
+// podtracerWrapperScript runs podtracer with its arguments as positional
+// parameters. It waits for the shared start time of a synchronized start and
+// passes it on to podtracer with --start-at. It applies the stop conditions
+// and the output file of the step, all passed as environment variables, and reports the stop reason and the
+// exit code of steps allowed to fail in the termination message.
+const podtracerWrapperScript = `
+run() {
+	/usr/bin/podtracer "$@"
+	echo $? > /tmp/snoopy-exit-code
+}
+
+match() {
+	if [ -z "$SNOOPY_STOP_PATTERN" ]; then cat; return; fi
+	awk '{ print; fflush() } $0 ~ ENVIRON["SNOOPY_STOP_PATTERN"] { system("touch /tmp/snoopy-stop-pattern"); exit }'
+}
+
+limit() {
+	if [ -z "$SNOOPY_MAX_BYTES" ]; then cat; return; fi
+	head -c "$SNOOPY_MAX_BYTES"
+	if [ "$(head -c 1 | wc -c)" -gt 0 ]; then touch /tmp/snoopy-stop-max-bytes; fi
+}
+
+write() {
+	if [ -z "$SNOOPY_OUTPUT_FILE" ]; then cat; return; fi
+	mkdir -p "$(dirname "$SNOOPY_OUTPUT_FILE")" && cat > "$SNOOPY_OUTPUT_FILE"
+}
+
+if [ -n "$SNOOPY_START_AT_FILE" ]; then
+	# The operator sets the start time once all workers are ready.
+	until [ -s "$SNOOPY_START_AT_FILE" ]; do sleep 0.5; done
+	start_at=$(cat "$SNOOPY_START_AT_FILE")
+	sleep "$(awk -v start="$(date -u -d "$start_at" +%s.%N)" -v now="$(date -u +%s.%N)" 'BEGIN { d = start - now; printf "%.3f", d > 0 ? d : 0 }')"
+	echo "snoopy-started-at=$(date -u +%Y-%m-%dT%H:%M:%S.%NZ)" >&2
+	set -- "$@" --start-at "$start_at"
+fi
+
+run "$@" | match | limit | write
+status=$?
+rc=$(cat /tmp/snoopy-exit-code 2>/dev/null || echo 1)
+
+reason=
+[ -f /tmp/snoopy-stop-pattern ] && reason=Pattern
+[ -f /tmp/snoopy-stop-max-bytes ] && reason=MaxBytes
+if [ -n "$reason" ]; then
+	# podtracer was cut off on purpose.
+	rc=0
+	echo "stopReason=$reason" >> /dev/termination-log
+fi
+[ "$status" -ne 0 ] && rc=$status
+
+if [ -n "$SNOOPY_CONTINUE_ON_ERROR" ]; then
+	echo "exitCode=$rc" >> /dev/termination-log
+	exit 0
+fi
+exit "$rc"
+`
+
+// workerBase names the workers of a SnoopyJob on a target,
+// <namespace>.<name>-<target>. Namespaces hold no dots, so SnoopyJobs of the
+// same name in different namespaces get workers of their own.
+func workerBase(snoopyJob *jobv1alpha1.SnoopyJob, target target) string {
+	return snoopyJob.Namespace + "." + snoopyJob.Name + "-" + target.name
+}
+
+// workerName returns the name of a Job or CronJob, the base name followed by
+// the suffix. A name longer than maxLength gets its base name cut and a hash
+// of it appended, keeping names unique and the suffix readable.
+func workerName(base string, suffix string, maxLength int) string {
+
+	if len(base)+len(suffix) <= maxLength {
+		return base + suffix
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(base))
+	sum := strconv.FormatUint(uint64(hash.Sum32()), 16)
+
+	cut := strings.TrimRight(base[:maxLength-len(suffix)-len(sum)-1], "-.")
+	return cut + "-" + sum + suffix
+}
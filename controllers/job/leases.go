@@ -0,0 +1,232 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	apimachinery "k8s.io/apimachinery/pkg/types"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// Each target is captured by one SnoopyJob at a time. The SnoopyJob holding
+// a target is the holder identity of a Lease named after it in the
+// snoopy-operator namespace. SnoopyJobs in other namespaces can't own the
+// Lease, so it is deleted by the SnoopyJob itself once done with the target
+// or, through a finalizer, when deleted. Leases are read straight from the
+// API server rather than cached, so the Node heartbeats are not cached along
+// with them.
+
+// holderIdentity identifies a SnoopyJob as the holder of a Lease.
+func holderIdentity(snoopyJob *jobv1alpha1.SnoopyJob) string {
+	return snoopyJob.Namespace + "/" + snoopyJob.Name
+}
+
+// leaseName names the Lease of the target of a worker Pod template.
+func leaseName(snoopyJob *jobv1alpha1.SnoopyJob, template *corev1.PodTemplateSpec) string {
+
+	// Node targets are named node-<name> already.
+	target := template.Labels[snoopyTargetLabel]
+	if template.Spec.HostNetwork {
+		return "snoopy-" + target
+	}
+
+	return "snoopy-" + snoopyJob.Spec.TargetNamespace + "." + target
+}
+
+// claimTarget takes the Lease of the target of a worker Pod template for a
+// SnoopyJob. It returns the conflict instead when another SnoopyJob holds
+// the target or when the target was rejected before.
+func (r *SnoopyJobReconciler) claimTarget(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, template *corev1.PodTemplateSpec) (*jobv1alpha1.TargetConflict, error) {
+
+	target := template.Labels[snoopyTargetLabel]
+	for _, conflict := range snoopyJob.Status.Conflicts {
+		if conflict.Target == target && conflict.Rejected {
+			return conflict.DeepCopy(), nil
+		}
+	}
+
+	holder, err := r.acquireTarget(ctx, snoopyJob, template)
+	if err != nil || holder == "" {
+		return nil, err
+	}
+
+	return &jobv1alpha1.TargetConflict{
+		Target:    target,
+		BlockedBy: holder,
+		Rejected:  snoopyJob.Spec.ConflictPolicy == jobv1alpha1.ConflictReject,
+	}, nil
+}
+
+// acquireTarget takes the Lease of a target for a SnoopyJob. It returns the
+// SnoopyJob holding the target instead, if any.
+func (r *SnoopyJobReconciler) acquireTarget(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, template *corev1.PodTemplateSpec) (string, error) {
+
+	leases := r.Clientset.CoordinationV1().Leases("snoopy-operator")
+
+	lease, err := leases.Get(ctx, leaseName(snoopyJob, template), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		lease = targetLease(snoopyJob, template)
+		// Losing the race to another SnoopyJob fails and is retried.
+		_, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	holder := ""
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+	if holder == holderIdentity(snoopyJob) {
+		return "", nil
+	}
+
+	// Leases left behind by deleted SnoopyJobs are taken over.
+	held, err := r.holderExists(ctx, holder)
+	if err != nil || held {
+		return holder, err
+	}
+
+	taken := targetLease(snoopyJob, template)
+	taken.ResourceVersion = lease.ResourceVersion
+	_, err = leases.Update(ctx, taken, metav1.UpdateOptions{})
+	return "", err
+}
+
+// targetLease builds the Lease of a target held by a SnoopyJob.
+func targetLease(snoopyJob *jobv1alpha1.SnoopyJob, template *corev1.PodTemplateSpec) *coordinationv1.Lease {
+
+	identity := holderIdentity(snoopyJob)
+	now := metav1.NewMicroTime(time.Now())
+
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      leaseName(snoopyJob, template),
+			Namespace: "snoopy-operator",
+			Labels: map[string]string{
+				snoopyJobLabel:          snoopyJob.Name,
+				snoopyJobNamespaceLabel: snoopyJob.Namespace,
+				snoopyTargetLabel:       template.Labels[snoopyTargetLabel],
+			},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity: &identity,
+			AcquireTime:    &now,
+			RenewTime:      &now,
+		},
+	}
+}
+
+// holderExists tells whether the SnoopyJob holding a Lease still exists.
+func (r *SnoopyJobReconciler) holderExists(ctx context.Context, holder string) (bool, error) {
+
+	namespaceName := strings.SplitN(holder, "/", 2)
+	if len(namespaceName) != 2 {
+		return false, nil
+	}
+
+	err := r.Client.Get(ctx, apimachinery.NamespacedName{Namespace: namespaceName[0], Name: namespaceName[1]}, &jobv1alpha1.SnoopyJob{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// releaseTargets deletes the Leases of the targets a SnoopyJob is done with,
+// all of them once it expired or stopped and those whose run ended for good otherwise.
+func (r *SnoopyJobReconciler) releaseTargets(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob) error {
+
+	ended := snoopyJob.Status.Phase == jobv1alpha1.SnoopyJobExpired || snoopyJob.Status.Phase == jobv1alpha1.SnoopyJobStopped
+	if ended {
+		// Nothing is queued past the activation window or once stopped.
+		conflicts := []jobv1alpha1.TargetConflict{}
+		for _, conflict := range snoopyJob.Status.Conflicts {
+			if conflict.Rejected {
+				conflicts = append(conflicts, conflict)
+			}
+		}
+		// Updating Status.
+		snoopyJob.Status.Conflicts = conflicts
+	}
+
+	done := map[string]bool{}
+	for _, outcome := range snoopyJob.Status.Outcomes {
+		if outcome.Outcome == jobv1alpha1.TargetSucceeded || outcome.Outcome == jobv1alpha1.TargetFailed {
+			done[outcome.Target] = true
+		}
+	}
+
+	// Scheduled runs keep their targets until the SnoopyJob expires.
+	if !ended && (snoopyJob.Spec.Schedule != "" || len(done) == 0) {
+		return nil
+	}
+
+	return r.deleteLeases(ctx, snoopyJob, func(target string) bool {
+		return ended || done[target]
+	})
+}
+
+// releaseAllTargets deletes all the Leases held by a SnoopyJob.
+func (r *SnoopyJobReconciler) releaseAllTargets(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob) error {
+	return r.deleteLeases(ctx, snoopyJob, func(string) bool {
+		return true
+	})
+}
+
+// deleteLeases deletes the Leases held by a SnoopyJob of the targets release picks.
+func (r *SnoopyJobReconciler) deleteLeases(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, release func(target string) bool) error {
+
+	leases := r.Clientset.CoordinationV1().Leases("snoopy-operator")
+	leaseList, err := leases.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{snoopyJobLabel: snoopyJob.Name}).String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// SnoopyJobs of the same name in other namespaces hold Leases with the same label.
+	for _, lease := range leaseList.Items {
+		holder := lease.Spec.HolderIdentity
+		if holder == nil || *holder != holderIdentity(snoopyJob) || !release(lease.Labels[snoopyTargetLabel]) {
+			continue
+		}
+		if err := leases.Delete(ctx, lease.Name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasQueuedTargets tells whether some targets of a SnoopyJob wait for another SnoopyJob.
+func hasQueuedTargets(snoopyJob *jobv1alpha1.SnoopyJob) bool {
+	for _, conflict := range snoopyJob.Status.Conflicts {
+		if !conflict.Rejected {
+			return true
+		}
+	}
+	return false
+}
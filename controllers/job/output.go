@@ -0,0 +1,281 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"path"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apimachinery "k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// outputSink returns where the output of a SnoopyJob goes. It is empty when
+// the output only ends up in the worker Pod logs.
+func outputSink(snoopyJob *jobv1alpha1.SnoopyJob) jobv1alpha1.OutputSinkType {
+
+	if output := snoopyJob.Spec.Output; output != nil {
+		switch output.Type {
+		case jobv1alpha1.PersistentVolumeClaimSink:
+			if output.PersistentVolumeClaim == nil {
+				return ""
+			}
+			return output.Type
+		case jobv1alpha1.ConfigMapSink:
+			return output.Type
+		case jobv1alpha1.DataEndpointSink:
+		}
+	}
+
+	// The data endpoint sink needs an address to stream to.
+	if snoopyJob.Spec.DataServiceIP != "" {
+		return jobv1alpha1.DataEndpointSink
+	}
+
+	return ""
+}
+
+// reconcileArtifacts records where the output of each finished run ended up,
+// storing it first in a ConfigMap for the ConfigMap sink.
+func (r *SnoopyJobReconciler) reconcileArtifacts(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, workers *corev1.PodList) error {
+
+	sink := outputSink(snoopyJob)
+	if sink == "" {
+		return nil
+	}
+
+	artifacts := append([]jobv1alpha1.Artifact{}, snoopyJob.Status.Artifacts...)
+	recorded := map[string]bool{}
+	for _, artifact := range artifacts {
+		recorded[artifact.Run] = true
+	}
+	overall, byTarget := pruningCutoffs(artifacts)
+
+	for i := range workers.Items {
+		pod := &workers.Items[i]
+		if recorded[pod.Name] || (pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed) {
+			continue
+		}
+
+		// Runs finished no later than the oldest artifact kept were
+		// recorded and pruned already.
+		if completion := podCompletionTime(pod); notAfter(completion, overall) || notAfter(completion, byTarget[pod.Labels[snoopyTargetLabel]]) {
+			continue
+		}
+
+		target := pod.Labels[snoopyTargetLabel]
+		artifact := jobv1alpha1.Artifact{
+			Target:         target,
+			Run:            pod.Name,
+			Sink:           sink,
+			CompletionTime: podCompletionTime(pod),
+		}
+
+		switch sink {
+		case jobv1alpha1.DataEndpointSink:
+			artifact.Location = dataEndpointLocation(snoopyJob, pod)
+
+		case jobv1alpha1.PersistentVolumeClaimSink:
+			claimName := snoopyJob.Spec.Output.PersistentVolumeClaim.ClaimName
+			artifact.Location = claimName + ":" + path.Join("/", pod.Annotations[outputDirAnnotation], pod.Name)
+
+		case jobv1alpha1.ConfigMapSink:
+			configMap, err := r.reconcileOutputConfigMap(ctx, snoopyJob, pod)
+			if err != nil {
+				return err
+			}
+			artifact.Location = configMap.Namespace + "/" + configMap.Name
+			artifact.Truncated = configMap.Annotations[outputTruncatedAnnotation] == "true"
+		}
+
+		artifacts = append(artifacts, artifact)
+	}
+
+	// Updating Status.
+	updateArtifacts(&snoopyJob.Status, artifacts)
+	return nil
+}
+
+// dataEndpointLocation is where the data endpoint keeps the output of the
+// target of a worker Pod.
+func dataEndpointLocation(snoopyJob *jobv1alpha1.SnoopyJob, pod *corev1.Pod) string {
+	return workerDataAddress(snoopyJob, pod) + "/" + pod.Labels[snoopyTargetLabel]
+}
+
+// reconcileOutputConfigMap stores the logs of each step of a finished worker
+// Pod in a ConfigMap, up to the configured size.
+func (r *SnoopyJobReconciler) reconcileOutputConfigMap(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, pod *corev1.Pod) (*corev1.ConfigMap, error) {
+
+	configMap := &corev1.ConfigMap{}
+	err := r.Client.Get(ctx, apimachinery.NamespacedName{Namespace: pod.Namespace, Name: "snoopy-output-" + pod.Name}, configMap)
+	if err == nil {
+		return configMap, nil
+	}
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	configMap = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "snoopy-output-" + pod.Name,
+			Namespace: pod.Namespace,
+			Labels: map[string]string{
+				snoopyJobLabel:          snoopyJob.Name,
+				snoopyJobNamespaceLabel: snoopyJob.Namespace,
+				snoopyTargetLabel:       pod.Labels[snoopyTargetLabel],
+			},
+			Annotations: map[string]string{},
+		},
+		Data:       map[string]string{},
+		BinaryData: map[string][]byte{},
+	}
+
+	remaining := configMapOutputSize(snoopyJob)
+	for _, step := range jobSteps(snoopyJob) {
+		if remaining <= 0 {
+			configMap.Annotations[outputTruncatedAnnotation] = "true"
+			break
+		}
+
+		// Ask for one more byte than allowed to find out whether the output was cut.
+		limit := remaining + 1
+		logs, err := r.Clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+			Container:  step.Name,
+			LimitBytes: &limit,
+		}).DoRaw(ctx)
+		if err != nil {
+			// Steps that never started have no logs.
+			if errors.IsBadRequest(err) || errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		logs = stripStartedAt(logs)
+		if int64(len(logs)) > remaining {
+			logs = logs[:remaining]
+			configMap.Annotations[outputTruncatedAnnotation] = "true"
+		}
+		remaining -= int64(len(logs))
+
+		if utf8.Valid(logs) {
+			configMap.Data[step.Name] = string(logs)
+		} else {
+			configMap.BinaryData[step.Name] = logs
+		}
+	}
+
+	if err := ctrl.SetControllerReference(snoopyJob, configMap, r.Scheme); err != nil {
+		return nil, err
+	}
+
+	return configMap, r.Client.Create(ctx, configMap)
+}
+
+// configMapOutputSize returns how many bytes of output the ConfigMap sink keeps per run.
+func configMapOutputSize(snoopyJob *jobv1alpha1.SnoopyJob) int64 {
+
+	size := int64(defaultConfigMapOutputSize)
+	if output := snoopyJob.Spec.Output; output != nil && output.ConfigMap != nil && output.ConfigMap.MaxSize != nil {
+		size = output.ConfigMap.MaxSize.Value()
+	}
+
+	if size > maxConfigMapOutputSize {
+		size = maxConfigMapOutputSize
+	}
+
+	return size
+}
+
+// podCompletionTime returns when the last container of a finished Pod terminated.
+func podCompletionTime(pod *corev1.Pod) *metav1.Time {
+
+	var completion *metav1.Time
+	for _, status := range pod.Status.ContainerStatuses {
+		if terminated := status.State.Terminated; terminated != nil {
+			if completion == nil || completion.Before(&terminated.FinishedAt) {
+				completion = terminated.FinishedAt.DeepCopy()
+			}
+		}
+	}
+
+	return completion
+}
+
+// pruningCutoffs returns the completion time of the oldest artifact kept
+// overall and for each target, once there are as many as can be kept.
+func pruningCutoffs(artifacts []jobv1alpha1.Artifact) (*metav1.Time, map[string]*metav1.Time) {
+
+	var overall *metav1.Time
+	byTarget := map[string]*metav1.Time{}
+	count := map[string]int{}
+	oldest := func(cutoff *metav1.Time, artifact jobv1alpha1.Artifact) *metav1.Time {
+		if cutoff == nil || artifact.CompletionTime.Before(cutoff) {
+			return artifact.CompletionTime
+		}
+		return cutoff
+	}
+
+	for _, artifact := range artifacts {
+		count[artifact.Target]++
+		if artifact.CompletionTime == nil {
+			continue
+		}
+		overall = oldest(overall, artifact)
+		byTarget[artifact.Target] = oldest(byTarget[artifact.Target], artifact)
+	}
+
+	for target := range byTarget {
+		if count[target] < maxArtifactsPerTarget {
+			delete(byTarget, target)
+		}
+	}
+	if len(artifacts) < maxStatusEntries {
+		overall = nil
+	}
+
+	return overall, byTarget
+}
+
+func notAfter(completion *metav1.Time, cutoff *metav1.Time) bool {
+	return completion != nil && cutoff != nil && !cutoff.Before(completion)
+}
+
+// updateArtifacts records the artifacts of a SnoopyJob, counting those pruned.
+func updateArtifacts(status *jobv1alpha1.SnoopyJobStatus, artifacts []jobv1alpha1.Artifact) {
+	status.Artifacts = pruneArtifacts(artifacts)
+	status.PrunedArtifacts += int32(len(artifacts) - len(status.Artifacts))
+}
+
+// pruneArtifacts keeps the most recent artifacts of each target.
+func pruneArtifacts(artifacts []jobv1alpha1.Artifact) []jobv1alpha1.Artifact {
+
+	kept := map[string]int{}
+	pruned := []jobv1alpha1.Artifact{}
+	for i := len(artifacts) - 1; i >= 0; i-- {
+		if kept[artifacts[i].Target] < maxArtifactsPerTarget {
+			kept[artifacts[i].Target]++
+			pruned = append([]jobv1alpha1.Artifact{artifacts[i]}, pruned...)
+		}
+	}
+
+	return pruned
+}
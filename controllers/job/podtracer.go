@@ -0,0 +1,160 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"strings"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// The pinned podtracer image only takes `podtracer run <command> -a <args>
+// [-t <timer>] [-d <host> -p <port>] --pod <pod> -n <namespace>`. Whatever
+// else workers rely on is only used when the operator is told, through
+// -podtracer-features, that the image it runs supports it.
+const (
+	// featureTag is `run --tag <step>`, naming the stream of a step on the
+	// data endpoint. Several steps can't stream to a data endpoint without it.
+	featureTag = "tag"
+	// featureHost is `run --host`, running the command in the host network namespace of the Node.
+	featureHost = "host"
+	// featureStop is `run --max-bytes <bytes> --stop-pattern <regexp>`, sent
+	// as the snoopy-max-bytes and snoopy-stop-pattern stream metadata for the
+	// data endpoint to stop the stream.
+	featureStop = "stop"
+	// featureStartAt is `run --start-at <RFC3339 time>`, starting the
+	// command at the shared start time of a synchronized start.
+	featureStartAt = "start-at"
+	// featureShell is a /bin/sh with cat, awk, head, wc, mkdir and GNU date
+	// in the image, which podtracerWrapperScript runs podtracer with.
+	featureShell = "shell"
+	// featureJob is `run --job <snoopyJob>`, sent along with the namespace
+	// and the name of the target Pod as the snoopy-job, snoopy-namespace and
+	// snoopy-pod stream metadata the data endpoint indexes captures by.
+	featureJob = "job"
+)
+
+// podtracerImage is the image worker Pods run.
+func (r *SnoopyJobReconciler) podtracerImage() string {
+	if r.PodtracerImage != "" {
+		return r.PodtracerImage
+	}
+	return defaultPodtracerImage
+}
+
+// supports tells whether the podtracer image has a feature.
+func (r *SnoopyJobReconciler) supports(feature string) bool {
+	for _, f := range r.PodtracerFeatures {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// tagsSteps tells whether the steps of a SnoopyJob stream under names of
+// their own, <target>-<step>, rather than the name of their target.
+func (r *SnoopyJobReconciler) tagsSteps(snoopyJob *jobv1alpha1.SnoopyJob) bool {
+	return len(snoopyJob.Spec.Steps) > 0 && r.supports(featureTag)
+}
+
+// streamNames lists the data endpoint streams of the workers of a SnoopyJob
+// on a target.
+func (r *SnoopyJobReconciler) streamNames(snoopyJob *jobv1alpha1.SnoopyJob, target string) []string {
+
+	if !r.tagsSteps(snoopyJob) {
+		return []string{target}
+	}
+
+	names := []string{}
+	for _, step := range snoopyJob.Spec.Steps {
+		names = append(names, target+"-"+step.Name)
+	}
+	return names
+}
+
+// missingFeatures lists the features a SnoopyJob cannot run without that the
+// podtracer image lacks.
+func (r *SnoopyJobReconciler) missingFeatures(snoopyJob *jobv1alpha1.SnoopyJob) []string {
+
+	required := []string{}
+	if snoopyJob.Spec.TargetNodes != nil {
+		required = append(required, featureHost)
+	}
+	// Other sinks apply the stop conditions in the worker itself.
+	if stop := snoopyJob.Spec.StopCondition; stop != nil && outputSink(snoopyJob) == jobv1alpha1.DataEndpointSink &&
+		(stop.MaxBytes != nil || stop.Pattern != "") {
+		required = append(required, featureStop)
+	}
+	if snoopyJob.Spec.SynchronizedStart != nil {
+		required = append(required, featureStartAt)
+	}
+	// Without a shell workers only run podtracer itself.
+	if wrapsPodtracer(snoopyJob) {
+		required = append(required, featureShell)
+	}
+	// Untagged steps would all stream under the name of their target,
+	// their output mixed up on the data endpoint.
+	if len(snoopyJob.Spec.Steps) > 1 && outputSink(snoopyJob) == jobv1alpha1.DataEndpointSink {
+		required = append(required, featureTag)
+	}
+
+	missing := []string{}
+	for _, feature := range required {
+		if !r.supports(feature) {
+			missing = append(missing, feature)
+		}
+	}
+	return missing
+}
+
+// wrapsPodtracer tells whether the workers of a SnoopyJob run podtracer
+// through podtracerWrapperScript: when they write its output to a claim,
+// apply the stop conditions themselves, hide the exit code of steps allowed
+// to fail or wait for a synchronized start.
+func wrapsPodtracer(snoopyJob *jobv1alpha1.SnoopyJob) bool {
+
+	sink := outputSink(snoopyJob)
+	if sink == jobv1alpha1.PersistentVolumeClaimSink || snoopyJob.Spec.SynchronizedStart != nil {
+		return true
+	}
+	if stop := snoopyJob.Spec.StopCondition; stop != nil && sink != jobv1alpha1.DataEndpointSink &&
+		(stop.MaxBytes != nil || stop.Pattern != "") {
+		return true
+	}
+	for _, step := range jobSteps(snoopyJob) {
+		if step.ContinueOnError {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectUnsupported moves a SnoopyJob needing features the podtracer image
+// lacks to the Rejected phase. It returns false when the SnoopyJob can run.
+func (r *SnoopyJobReconciler) rejectUnsupported(snoopyJob *jobv1alpha1.SnoopyJob) bool {
+
+	missing := r.missingFeatures(snoopyJob)
+	if len(missing) == 0 {
+		// Updating Status.
+		snoopyJob.Status.Message = ""
+		return false
+	}
+
+	// Updating Status.
+	snoopyJob.Status.Phase = jobv1alpha1.SnoopyJobRejected
+	snoopyJob.Status.Message = "podtracer image " + r.podtracerImage() + " does not support " + strings.Join(missing, ", ")
+	return true
+}
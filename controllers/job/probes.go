@@ -0,0 +1,365 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// probe is a destination address probed by a step of a connectivity check.
+type probe struct {
+	Step        string `json:"step"`
+	Destination string `json:"destination"`
+	Address     string `json:"address"`
+}
+
+var (
+	pingSummary = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received`)
+	pingRTT     = regexp.MustCompile(`= [\d.]+/([\d.]+)/`)
+	digStatus   = regexp.MustCompile(`status: (\w+)`)
+	digTime     = regexp.MustCompile(`Query time: (\d+) msec`)
+)
+
+// validateDestinations checks that the destinations of a check can be probed
+// the way it asks for.
+func validateDestinations(check *jobv1alpha1.SnoopyConnectivityCheck) error {
+
+	if check.Spec.Probe.Type != jobv1alpha1.DNSProbe {
+		return nil
+	}
+
+	// There is nothing to resolve in an IP address.
+	for _, destination := range check.Spec.Destinations {
+		if destination.Pods != nil {
+			return fmt.Errorf("destination %s: DNS probes need a name, pods are probed on their IP", destination.Name)
+		}
+		if net.ParseIP(destination.Host) != nil {
+			return fmt.Errorf("destination %s: DNS probes need a name, not the IP address %s", destination.Name, destination.Host)
+		}
+	}
+
+	return nil
+}
+
+// resolveProbes resolves the destinations of a check to the addresses probed.
+func (r *SnoopyConnectivityCheckReconciler) resolveProbes(ctx context.Context, check *jobv1alpha1.SnoopyConnectivityCheck) ([]probe, error) {
+
+	probes := []probe{}
+	for _, destination := range check.Spec.Destinations {
+
+		addresses := []string{}
+		switch {
+		case destination.Pods != nil:
+			podlist := &corev1.PodList{}
+			listOpts := []client.ListOption{
+				client.MatchingLabels(destination.Pods.LabelSelector),
+				client.InNamespace(destination.Pods.Namespace),
+			}
+			if err := r.Client.List(ctx, podlist, listOpts...); err != nil {
+				return nil, err
+			}
+			sort.Slice(podlist.Items, func(i, j int) bool {
+				return podlist.Items[i].Name < podlist.Items[j].Name
+			})
+			for _, pod := range podlist.Items {
+				if pod.Status.Phase == corev1.PodRunning && pod.Status.PodIP != "" {
+					addresses = append(addresses, pod.Status.PodIP)
+				}
+			}
+
+		case destination.Service != nil:
+			addresses = append(addresses, destination.Service.Name+"."+destination.Service.Namespace+".svc")
+
+		case destination.Host != "":
+			addresses = append(addresses, destination.Host)
+
+		default:
+			return nil, fmt.Errorf("destination %s has no pods, service or host", destination.Name)
+		}
+
+		for _, address := range addresses {
+			probes = append(probes, probe{
+				Step:        probeStepName(destination.Name, address),
+				Destination: destination.Name,
+				Address:     address,
+			})
+		}
+	}
+
+	return probes, nil
+}
+
+// probeStepName names the step probing an address, the same across reconciles.
+func probeStepName(destination string, address string) string {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(destination + "/" + address))
+	return fmt.Sprintf("probe-%08x", hash.Sum32())
+}
+
+// probeSteps builds the SnoopyJob steps running the probes. Probes failing
+// must not keep the following ones from running.
+func probeSteps(spec jobv1alpha1.Probe, probes []probe) []jobv1alpha1.Step {
+
+	steps := []jobv1alpha1.Step{}
+	for _, probe := range probes {
+		command, args := probeCommand(spec, probe.Address)
+		steps = append(steps, jobv1alpha1.Step{
+			Name:            probe.Step,
+			Command:         command,
+			Args:            args,
+			ContinueOnError: true,
+		})
+	}
+
+	return steps
+}
+
+// probeCommand returns the command and arguments sending Count probes to an address.
+func probeCommand(spec jobv1alpha1.Probe, address string) (string, string) {
+
+	count, timeout := probeCount(spec), spec.TimeoutSeconds
+	if timeout == 0 {
+		timeout = 2
+	}
+
+	switch spec.Type {
+	case jobv1alpha1.ICMPProbe:
+		return "ping", fmt.Sprintf("-c %d -W %d %s", count, timeout, address)
+
+	case jobv1alpha1.TCPProbe:
+		url := "http://" + net.JoinHostPort(address, strconv.Itoa(int(spec.Port))) + "/"
+		return "curl", fmt.Sprintf("-s -o /dev/null --connect-timeout %d -m %d -w %s%%{time_connect}\\n %s",
+			timeout, timeout, probeOutputPrefix, repeat(url, count))
+
+	case jobv1alpha1.HTTPProbe:
+		port, path := spec.Port, spec.Path
+		if port == 0 {
+			port = 80
+		}
+		if path == "" {
+			path = "/"
+		}
+		url := "http://" + net.JoinHostPort(address, strconv.Itoa(int(port))) + path
+		return "curl", fmt.Sprintf("-s -o /dev/null --connect-timeout %d -m %d -w %s%%{http_code},%%{time_total}\\n %s",
+			timeout, timeout, probeOutputPrefix, repeat(url, count))
+
+	case jobv1alpha1.DNSProbe:
+		// Service names are not fully qualified, so let the search list of
+		// the worker complete them as it would for a Pod.
+		return "dig", fmt.Sprintf("+search +tries=1 +time=%d +noall +comments +stats %s", timeout, repeat(address, count))
+	}
+
+	return "", ""
+}
+
+func probeCount(spec jobv1alpha1.Probe) int32 {
+	if spec.Count == 0 {
+		return 3
+	}
+	return spec.Count
+}
+
+func repeat(word string, count int32) string {
+	words := make([]string, count)
+	for i := range words {
+		words[i] = word
+	}
+	return strings.Join(words, " ")
+}
+
+// collectResults reads the probe results from the latest finished worker Pod
+// of each source. Results of runs already collected are kept as they are.
+func (r *SnoopyConnectivityCheckReconciler) collectResults(ctx context.Context, check *jobv1alpha1.SnoopyConnectivityCheck, snoopyJob *jobv1alpha1.SnoopyJob) ([]jobv1alpha1.ConnectivityResult, error) {
+
+	probes := []probe{}
+	if encodedProbes := snoopyJob.Annotations[probesAnnotation]; encodedProbes != "" {
+		if err := json.Unmarshal([]byte(encodedProbes), &probes); err != nil {
+			return nil, err
+		}
+	}
+
+	podlist := &corev1.PodList{}
+	listOpts := []client.ListOption{
+		client.MatchingLabels(snoopyJobLabels(snoopyJob)),
+		client.InNamespace("snoopy-operator"),
+	}
+	if err := r.Client.List(ctx, podlist, listOpts...); err != nil {
+		return nil, err
+	}
+
+	// Keep the most recent finished worker Pod per source.
+	latest := map[string]*corev1.Pod{}
+	sources := []string{}
+	for i := range podlist.Items {
+		pod := &podlist.Items[i]
+		if pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+			continue
+		}
+		source := pod.Labels[snoopyTargetLabel]
+		previous, found := latest[source]
+		if !found {
+			sources = append(sources, source)
+		}
+		if !found || previous.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			latest[source] = pod
+		}
+	}
+	sort.Strings(sources)
+
+	collected := map[string][]jobv1alpha1.ConnectivityResult{}
+	for _, result := range check.Status.Results {
+		collected[result.Source] = append(collected[result.Source], result)
+	}
+
+	results := []jobv1alpha1.ConnectivityResult{}
+	for _, source := range sources {
+		pod := latest[source]
+		probeTime := podCompletionTime(pod)
+
+		if previous := collected[source]; len(previous) > 0 && probeTime != nil && previous[0].ProbeTime.Equal(probeTime) {
+			results = append(results, previous...)
+			continue
+		}
+
+		for _, probe := range probes {
+			result, err := r.probeResult(ctx, check.Spec.Probe, pod, probe)
+			if err != nil {
+				return nil, err
+			}
+			result.ProbeTime = probeTime
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// probeResult reads the output of a probe step from its worker Pod logs.
+func (r *SnoopyConnectivityCheckReconciler) probeResult(ctx context.Context, spec jobv1alpha1.Probe, pod *corev1.Pod, probe probe) (jobv1alpha1.ConnectivityResult, error) {
+
+	result := jobv1alpha1.ConnectivityResult{
+		Source:      pod.Labels[snoopyTargetLabel],
+		Destination: probe.Destination,
+		Address:     probe.Address,
+	}
+
+	logs, err := r.Clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: probe.Step,
+	}).DoRaw(ctx)
+	if err != nil {
+		// The destination was added after this run or the step never started.
+		if errors.IsBadRequest(err) || errors.IsNotFound(err) {
+			result.Message = "probe did not run"
+			return result, nil
+		}
+		return result, err
+	}
+
+	sent, latencies := parseProbeOutput(spec.Type, probeCount(spec), string(logs))
+	result.Sent = sent
+	result.Succeeded = int32(len(latencies))
+	if sent > 0 {
+		result.SuccessRate = result.Succeeded * 100 / sent
+	}
+	if len(latencies) > 0 {
+		var total time.Duration
+		for _, latency := range latencies {
+			total += latency
+		}
+		result.Latency = &metav1.Duration{Duration: total / time.Duration(len(latencies))}
+	}
+
+	return result, nil
+}
+
+// parseProbeOutput returns how many probes were sent and the latency of
+// each successful one from the output of the probe command.
+func parseProbeOutput(probeType jobv1alpha1.ProbeType, count int32, output string) (int32, []time.Duration) {
+
+	latencies := []time.Duration{}
+
+	switch probeType {
+	case jobv1alpha1.ICMPProbe:
+		// ping only reports the average round trip time.
+		summary := pingSummary.FindStringSubmatch(output)
+		if summary == nil {
+			return count, latencies
+		}
+		sent, _ := strconv.Atoi(summary[1])
+		received, _ := strconv.Atoi(summary[2])
+		var average time.Duration
+		if rtt := pingRTT.FindStringSubmatch(output); rtt != nil {
+			milliseconds, _ := strconv.ParseFloat(rtt[1], 64)
+			average = time.Duration(milliseconds * float64(time.Millisecond))
+		}
+		for i := 0; i < received; i++ {
+			latencies = append(latencies, average)
+		}
+		return int32(sent), latencies
+
+	case jobv1alpha1.TCPProbe, jobv1alpha1.HTTPProbe:
+		for _, line := range strings.Split(output, "\n") {
+			if !strings.HasPrefix(line, probeOutputPrefix) {
+				continue
+			}
+			fields := strings.Split(strings.TrimPrefix(line, probeOutputPrefix), ",")
+			if probeType == jobv1alpha1.HTTPProbe {
+				// An HTTP probe succeeds on any answer short of an error status.
+				code, _ := strconv.Atoi(fields[0])
+				if code < 200 || code >= 400 || len(fields) < 2 {
+					continue
+				}
+				fields = fields[1:]
+			}
+			seconds, _ := strconv.ParseFloat(fields[0], 64)
+			if seconds > 0 {
+				latencies = append(latencies, time.Duration(seconds*float64(time.Second)))
+			}
+		}
+		return count, latencies
+
+	case jobv1alpha1.DNSProbe:
+		answered := false
+		for _, line := range strings.Split(output, "\n") {
+			if status := digStatus.FindStringSubmatch(line); status != nil {
+				answered = status[1] == "NOERROR"
+			}
+			if queryTime := digTime.FindStringSubmatch(line); queryTime != nil && answered {
+				milliseconds, _ := strconv.Atoi(queryTime[1])
+				latencies = append(latencies, time.Duration(milliseconds)*time.Millisecond)
+				answered = false
+			}
+		}
+		return count, latencies
+	}
+
+	return count, latencies
+}
@@ -0,0 +1,136 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+func TestParseProbeOutput(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		probeType jobv1alpha1.ProbeType
+		count     int32
+		output    string
+		sent      int32
+		latencies []time.Duration
+	}{
+		{
+			name:      "ping all received",
+			probeType: jobv1alpha1.ICMPProbe,
+			count:     3,
+			output: `PING 10.0.0.1 (10.0.0.1) 56(84) bytes of data.
+64 bytes from 10.0.0.1: icmp_seq=1 ttl=64 time=0.120 ms
+
+--- 10.0.0.1 ping statistics ---
+3 packets transmitted, 3 received, 0% packet loss, time 2003ms
+rtt min/avg/max/mdev = 0.100/0.250/0.400/0.050 ms
+`,
+			sent:      3,
+			latencies: []time.Duration{250 * time.Microsecond, 250 * time.Microsecond, 250 * time.Microsecond},
+		},
+		{
+			name:      "busybox ping partial loss",
+			probeType: jobv1alpha1.ICMPProbe,
+			count:     4,
+			output: `--- 10.0.0.1 ping statistics ---
+4 packets transmitted, 1 packets received, 75% packet loss
+round-trip min/avg/max = 1.500/1.500/1.500 ms
+`,
+			sent:      4,
+			latencies: []time.Duration{1500 * time.Microsecond},
+		},
+		{
+			name:      "ping all lost",
+			probeType: jobv1alpha1.ICMPProbe,
+			count:     3,
+			output:    "3 packets transmitted, 0 received, 100% packet loss, time 2030ms\n",
+			sent:      3,
+			latencies: []time.Duration{},
+		},
+		{
+			name:      "ping without summary",
+			probeType: jobv1alpha1.ICMPProbe,
+			count:     3,
+			output:    "ping: bad address 'nowhere'\n",
+			sent:      3,
+			latencies: []time.Duration{},
+		},
+		{
+			name:      "tcp connects and timeouts",
+			probeType: jobv1alpha1.TCPProbe,
+			count:     3,
+			output:    probeOutputPrefix + "0.001500\n" + probeOutputPrefix + "0.000000\nnoise\n" + probeOutputPrefix + "0.002\n",
+			sent:      3,
+			latencies: []time.Duration{1500 * time.Microsecond, 2 * time.Millisecond},
+		},
+		{
+			name:      "http status codes",
+			probeType: jobv1alpha1.HTTPProbe,
+			count:     4,
+			output: probeOutputPrefix + "200,0.010\n" + probeOutputPrefix + "302,0.020\n" +
+				probeOutputPrefix + "503,0.030\n" + probeOutputPrefix + "000,0.000\n",
+			sent:      4,
+			latencies: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+		},
+		{
+			name:      "http without time",
+			probeType: jobv1alpha1.HTTPProbe,
+			count:     1,
+			output:    probeOutputPrefix + "200\n",
+			sent:      1,
+			latencies: []time.Duration{},
+		},
+		{
+			name:      "dig answers and errors",
+			probeType: jobv1alpha1.DNSProbe,
+			count:     3,
+			output: `;; ->>HEADER<<- opcode: QUERY, status: NOERROR, id: 1
+;; Query time: 4 msec
+;; ->>HEADER<<- opcode: QUERY, status: NXDOMAIN, id: 2
+;; Query time: 3 msec
+;; ->>HEADER<<- opcode: QUERY, status: NOERROR, id: 3
+;; Query time: 12 msec
+`,
+			sent:      3,
+			latencies: []time.Duration{4 * time.Millisecond, 12 * time.Millisecond},
+		},
+		{
+			name:      "dig timed out",
+			probeType: jobv1alpha1.DNSProbe,
+			count:     2,
+			output:    ";; connection timed out; no servers could be reached\n",
+			sent:      2,
+			latencies: []time.Duration{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sent, latencies := parseProbeOutput(test.probeType, test.count, test.output)
+			if sent != test.sent {
+				t.Errorf("sent = %d, want %d", sent, test.sent)
+			}
+			if !reflect.DeepEqual(latencies, test.latencies) {
+				t.Errorf("latencies = %v, want %v", latencies, test.latencies)
+			}
+		})
+	}
+}
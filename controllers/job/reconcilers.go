@@ -16,102 +16,185 @@ package job
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"net"
+	"path"
+	"strconv"
 
-	"k8s.io/apimachinery/pkg/api/errors"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
-	apimachinery "k8s.io/apimachinery/pkg/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 
 	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
 )
 
-func (r *SnoopyJobReconciler) reconcileCronJobs(snoopyJob *jobv1alpha1.SnoopyJob, cronJobs *batchv1.CronJobList) error {
+// reconcileCronJobs applies the CronJobs of a SnoopyJob that are missing or
+// whose spec changed since they were last applied. Missing CronJobs are only
+// created once their target is claimed.
+func (r *SnoopyJobReconciler) reconcileCronJobs(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, existing *batchv1.CronJobList, cronJobs *batchv1.CronJobList) error {
 
-	for i := range cronJobs.Items {
+	applied := map[string]string{}
+	for _, cronJob := range existing.Items {
+		applied[cronJob.Name] = cronJob.Annotations[specHashAnnotation]
+	}
 
-		err := r.Client.Get(context.TODO(), apimachinery.NamespacedName{Namespace: cronJobs.Items[i].ObjectMeta.Namespace, Name: cronJobs.Items[i].ObjectMeta.Name}, &cronJobs.Items[i])
-		if err != nil {
-			if errors.IsNotFound(err) {
-				err = r.Client.Create(context.Background(), &cronJobs.Items[i])
-				if err != nil {
-					fmt.Println(err.Error())
-					return err
-				}
-
-				// Updating Status.
-				snoopyJob.Status.CronJobList = append(snoopyJob.Status.CronJobList, cronJobs.Items[i].ObjectMeta.Name)
-				err = r.Client.Status().Update(context.Background(), snoopyJob)
-				if err != nil {
-					return nil
-				}
-			} else {
+	names := []string{}
+	conflicts := []jobv1alpha1.TargetConflict{}
+	for i := range cronJobs.Items {
+		cronJob := &cronJobs.Items[i]
 
+		appliedHash, found := applied[cronJob.Name]
+		if !found {
+			conflict, err := r.claimTarget(ctx, snoopyJob, &cronJob.Spec.JobTemplate.Spec.Template)
+			if err != nil {
 				return err
 			}
+			if conflict != nil {
+				conflicts = append(conflicts, *conflict)
+				continue
+			}
+		}
+		names = append(names, cronJob.Name)
+
+		hash, err := specHash(cronJob.Spec)
+		if err != nil {
+			return err
+		}
+		if found && appliedHash == hash {
+			continue
+		}
+
+		cronJob.TypeMeta = metav1.TypeMeta{APIVersion: "batch/v1", Kind: "CronJob"}
+		cronJob.Annotations = map[string]string{specHashAnnotation: hash}
+		if err := r.Client.Patch(ctx, cronJob, client.Apply, client.FieldOwner(fieldOwner), client.ForceOwnership); err != nil {
+			return err
 		}
 	}
 
+	// Updating Status.
+	snoopyJob.Status.CronJobList = names
+	snoopyJob.Status.Workers = int32(len(names))
+	snoopyJob.Status.Conflicts = conflicts
 	return nil
 }
 
-func (r *SnoopyJobReconciler) reconcileJobs(snoopyJob *jobv1alpha1.SnoopyJob, jobs *batchv1.JobList) error {
+// reconcileJobs applies the missing Jobs of a SnoopyJob once their target is
+// claimed. The Pod template of a Job can't change, so existing Jobs are left alone.
+func (r *SnoopyJobReconciler) reconcileJobs(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, jobs *batchv1.JobList) error {
+
+	existing, err := r.listJobs(ctx, snoopyJob)
+	if err != nil {
+		return err
+	}
+
+	created := map[string]bool{}
+	for _, job := range existing.Items {
+		created[job.Name] = true
+	}
 
+	names := []string{}
+	conflicts := []jobv1alpha1.TargetConflict{}
 	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if created[job.Name] {
+			names = append(names, job.Name)
+			continue
+		}
 
-		err := r.Client.Get(context.TODO(), apimachinery.NamespacedName{Namespace: jobs.Items[i].ObjectMeta.Namespace, Name: jobs.Items[i].ObjectMeta.Name}, &jobs.Items[i])
+		conflict, err := r.claimTarget(ctx, snoopyJob, &job.Spec.Template)
 		if err != nil {
-			if errors.IsNotFound(err) {
-
-				err = r.Client.Create(context.Background(), &jobs.Items[i])
-				if err != nil {
-					fmt.Println(err.Error())
-					return err
-				}
-
-				// Updating Status.
-				snoopyJob.Status.CronJobList = append(snoopyJob.Status.CronJobList, jobs.Items[i].ObjectMeta.Name)
-				err = r.Client.Status().Update(context.Background(), snoopyJob)
-				if err != nil {
-					return err
-				}
-
-			} else {
-				return err
-			}
+			return err
+		}
+		if conflict != nil {
+			conflicts = append(conflicts, *conflict)
+			continue
+		}
+		names = append(names, job.Name)
+
+		job.TypeMeta = metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"}
+		if err := r.Client.Patch(ctx, job, client.Apply, client.FieldOwner(fieldOwner), client.ForceOwnership); err != nil {
+			return err
 		}
 	}
 
+	// Updating Status.
+	snoopyJob.Status.CronJobList = names
+	snoopyJob.Status.Workers = int32(len(names))
+	snoopyJob.Status.Conflicts = conflicts
 	return nil
 }
 
-func (r *SnoopyJobReconciler) buildCronJobForPods(snoopyJob *jobv1alpha1.SnoopyJob) (*batchv1.CronJobList, error) {
+// listJobs lists the Jobs of a SnoopyJob.
+func (r *SnoopyJobReconciler) listJobs(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob) (*batchv1.JobList, error) {
+
+	jobs := &batchv1.JobList{}
+	listOpts := []client.ListOption{
+		client.MatchingLabels(snoopyJobLabels(snoopyJob)),
+		client.MatchingFields{snoopyJobField: snoopyJobKey(snoopyJob.Namespace, snoopyJob.Name)},
+		client.InNamespace("snoopy-operator"),
+	}
+	if err := r.Client.List(ctx, jobs, listOpts...); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// specHash fingerprints the spec of a child to find out whether it has to be applied again.
+func specHash(spec interface{}) (string, error) {
+
+	encoded, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+
+	hash := fnv.New64a()
+	_, _ = hash.Write(encoded)
+	return strconv.FormatUint(hash.Sum64(), 16), nil
+}
+
+func (r *SnoopyJobReconciler) buildCronJobForTargets(snoopyJob *jobv1alpha1.SnoopyJob) (*batchv1.CronJobList, error) {
 
 	// Running reconciliation tasks.
-	// Target pod list by label and namespace.
-	podlist, err := r.getRunningPodsByLabel(context.TODO(), snoopyJob.Spec.LabelSelector, snoopyJob.Spec.TargetNamespace)
+	// Target pods by label and namespace, and target nodes.
+	targets, err := r.getTargets(context.TODO(), snoopyJob)
 	if err != nil {
 		fmt.Println(err.Error())
 		return nil, err
 	}
 
+	peers, err := r.getPeers(context.TODO(), snoopyJob)
+	if err != nil {
+		return nil, err
+	}
+
+	replicas, err := r.dataEndpointReplicas(context.TODO(), snoopyJob)
+	if err != nil {
+		return nil, err
+	}
+
+	templateErrors := []jobv1alpha1.TemplateError{}
 	cronJobs := &batchv1.CronJobList{}
-	// CronJob creation by target pod.
-	for _, pod := range podlist.Items {
+	// CronJob creation by target.
+	for _, target := range targets {
 
-		// Build the command with arguments for podtracer.
-		podtracerOpts := r.buildPodtracerOptions(snoopyJob)
+		target.dataAddress = replicaAddress(replicas, target.name)
 
-		podtracerOpts = append(podtracerOpts, "--pod")
-		podtracerOpts = append(podtracerOpts, pod.ObjectMeta.Name)
-		podtracerOpts = append(podtracerOpts, "-n")
-		podtracerOpts = append(podtracerOpts, pod.ObjectMeta.Namespace)
+		// Build the commands with arguments for podtracer.
+		// Targets whose arguments can't be rendered are left out.
+		podtracerSteps, stepErrors := r.buildPodtracerSteps(snoopyJob, target, newTemplateData(target, peers))
+		if len(stepErrors) > 0 {
+			templateErrors = append(templateErrors, stepErrors...)
+			continue
+		}
 
 		// Generate the Cronjob object.
-		cronJob, err := r.CronJob(podtracerOpts, pod.ObjectMeta.Name, pod.Spec.NodeName, snoopyJob.Spec.Schedule)
+		cronJob, err := r.CronJob(snoopyJob, podtracerSteps, target, snoopyJob.Spec.Schedule)
 		if err != nil {
 			return nil, err
 		}
@@ -121,33 +204,50 @@ func (r *SnoopyJobReconciler) buildCronJobForPods(snoopyJob *jobv1alpha1.SnoopyJ
 
 		cronJobs.Items = append(cronJobs.Items, *cronJob)
 	}
+
+	// Updating Status.
+	updateTemplateErrors(snoopyJob, templateErrors)
+
 	return cronJobs, nil
 }
 
-func (r *SnoopyJobReconciler) buildJobForPods(snoopyJob *jobv1alpha1.SnoopyJob) (*batchv1.JobList, error) {
+func (r *SnoopyJobReconciler) buildJobForTargets(snoopyJob *jobv1alpha1.SnoopyJob) (*batchv1.JobList, error) {
 
 	// Running reconciliation tasks.
-	// Target pod list by label and namespace.
-	podlist, err := r.getRunningPodsByLabel(context.TODO(), snoopyJob.Spec.LabelSelector, snoopyJob.Spec.TargetNamespace)
+	// Target pods by label and namespace, and target nodes.
+	targets, err := r.getTargets(context.TODO(), snoopyJob)
 	if err != nil {
 		fmt.Println(err.Error())
 		return nil, err
 	}
 
+	peers, err := r.getPeers(context.TODO(), snoopyJob)
+	if err != nil {
+		return nil, err
+	}
+
+	replicas, err := r.dataEndpointReplicas(context.TODO(), snoopyJob)
+	if err != nil {
+		return nil, err
+	}
+
+	templateErrors := []jobv1alpha1.TemplateError{}
 	jobs := &batchv1.JobList{}
-	// CronJob creation by target pod.
-	for _, pod := range podlist.Items {
+	// Job creation by target.
+	for _, target := range targets {
 
-		// Build the command with arguments for podtracer.
-		podtracerOpts := r.buildPodtracerOptions(snoopyJob)
+		target.dataAddress = replicaAddress(replicas, target.name)
 
-		podtracerOpts = append(podtracerOpts, "--pod")
-		podtracerOpts = append(podtracerOpts, pod.ObjectMeta.Name)
-		podtracerOpts = append(podtracerOpts, "-n")
-		podtracerOpts = append(podtracerOpts, pod.ObjectMeta.Namespace)
+		// Build the commands with arguments for podtracer.
+		// Targets whose arguments can't be rendered are left out.
+		podtracerSteps, stepErrors := r.buildPodtracerSteps(snoopyJob, target, newTemplateData(target, peers))
+		if len(stepErrors) > 0 {
+			templateErrors = append(templateErrors, stepErrors...)
+			continue
+		}
 
-		// Generate the Cronjob object.
-		job, err := r.Job(podtracerOpts, pod.ObjectMeta.Name, pod.Spec.NodeName)
+		// Generate the Job object.
+		job, err := r.Job(snoopyJob, podtracerSteps, target)
 		if err != nil {
 			return nil, err
 		}
@@ -157,30 +257,119 @@ func (r *SnoopyJobReconciler) buildJobForPods(snoopyJob *jobv1alpha1.SnoopyJob)
 
 		jobs.Items = append(jobs.Items, *job)
 	}
+
+	// Updating Status.
+	updateTemplateErrors(snoopyJob, templateErrors)
+
 	return jobs, nil
 }
 
-func (r *SnoopyJobReconciler) buildPodtracerOptions(snoopyJob *jobv1alpha1.SnoopyJob) []string {
+func (r *SnoopyJobReconciler) buildPodtracerSteps(snoopyJob *jobv1alpha1.SnoopyJob, target target, data templateData) ([]podtracerStep, []jobv1alpha1.TemplateError) {
+
+	podtracerSteps := []podtracerStep{}
+	templateErrors := []jobv1alpha1.TemplateError{}
+	for _, step := range jobSteps(snoopyJob) {
+
+		// Build the command with arguments for podtracer.
+		podtracerOpts, err := r.buildPodtracerOptions(snoopyJob, step, target, data)
+		if err != nil {
+			templateErrors = append(templateErrors, jobv1alpha1.TemplateError{
+				Target:  target.name,
+				Step:    step.Name,
+				Message: err.Error(),
+			})
+			continue
+		}
+		podtracerOpts = append(podtracerOpts, target.podtracerTargetOptions()...)
+
+		podtracerStep := podtracerStep{
+			name:            step.Name,
+			args:            podtracerOpts,
+			continueOnError: step.ContinueOnError,
+		}
+
+		// Each run gets its own directory, named after the worker Pod.
+		if outputSink(snoopyJob) == jobv1alpha1.PersistentVolumeClaimSink {
+			podtracerStep.outputFile = path.Join(outputMountPath, target.outputDir(), "$(POD_NAME)", step.Name)
+		}
+
+		// Streams to the data endpoint are stopped by the endpoint itself.
+		if stop := snoopyJob.Spec.StopCondition; stop != nil && outputSink(snoopyJob) != jobv1alpha1.DataEndpointSink {
+			if stop.MaxBytes != nil {
+				podtracerStep.maxBytes = stop.MaxBytes.Value()
+			}
+			podtracerStep.stopPattern = stop.Pattern
+		}
+
+		podtracerSteps = append(podtracerSteps, podtracerStep)
+	}
+	return podtracerSteps, templateErrors
+}
+
+func (r *SnoopyJobReconciler) buildPodtracerOptions(snoopyJob *jobv1alpha1.SnoopyJob, step jobv1alpha1.Step, target target, data templateData) ([]string, error) {
+
+	args, err := renderArgs(stepArgs(snoopyJob, step), data)
+	if err != nil {
+		return nil, err
+	}
 
 	podtracerOpts := []string{}
 	podtracerOpts = append(podtracerOpts, "run")
-	podtracerOpts = append(podtracerOpts, snoopyJob.Spec.Command)
+	podtracerOpts = append(podtracerOpts, step.Command)
 	podtracerOpts = append(podtracerOpts, "-a")
-	podtracerOpts = append(podtracerOpts, snoopyJob.Spec.Args)
+	podtracerOpts = append(podtracerOpts, args)
 
-	if snoopyJob.Spec.Timer != "" {
+	timer := step.Timeout
+	if timer == "" {
+		timer = snoopyJob.Spec.Timer
+	}
+	if timer != "" {
 		podtracerOpts = append(podtracerOpts, "-t")
-		podtracerOpts = append(podtracerOpts, snoopyJob.Spec.Timer)
+		podtracerOpts = append(podtracerOpts, timer)
 	}
 
-	if snoopyJob.Spec.DataServiceIP != "" {
+	if outputSink(snoopyJob) == jobv1alpha1.DataEndpointSink {
+		host, port := snoopyJob.Spec.DataServiceIP, snoopyJob.Spec.DataServicePort
+		if target.dataAddress != "" {
+			if host, port, err = net.SplitHostPort(target.dataAddress); err != nil {
+				return nil, err
+			}
+		}
 		podtracerOpts = append(podtracerOpts, "-d")
-		podtracerOpts = append(podtracerOpts, snoopyJob.Spec.DataServiceIP)
+		podtracerOpts = append(podtracerOpts, host)
 		podtracerOpts = append(podtracerOpts, "-p")
-		podtracerOpts = append(podtracerOpts, snoopyJob.Spec.DataServicePort)
+		podtracerOpts = append(podtracerOpts, port)
+
+		// Tag the streamed output so steps can be told apart on the data
+		// endpoint. Without it the steps of a target share its stream.
+		if r.tagsSteps(snoopyJob) {
+			podtracerOpts = append(podtracerOpts, "--tag")
+			podtracerOpts = append(podtracerOpts, step.Name)
+		}
+
+		// podtracer passes the SnoopyJob along as stream metadata, with the
+		// namespace and the name of the target Pod, for the data endpoint to
+		// index the capture by. Without it the capture is only known by its
+		// stream name.
+		if r.supports(featureJob) {
+			podtracerOpts = append(podtracerOpts, "--job")
+			podtracerOpts = append(podtracerOpts, snoopyJob.Name)
+		}
+
+		// podtracer passes these along as stream metadata for the data endpoint to enforce.
+		if stop := snoopyJob.Spec.StopCondition; stop != nil {
+			if stop.MaxBytes != nil {
+				podtracerOpts = append(podtracerOpts, "--max-bytes")
+				podtracerOpts = append(podtracerOpts, strconv.FormatInt(stop.MaxBytes.Value(), 10))
+			}
+			if stop.Pattern != "" {
+				podtracerOpts = append(podtracerOpts, "--stop-pattern")
+				podtracerOpts = append(podtracerOpts, stop.Pattern)
+			}
+		}
 	}
 
-	return podtracerOpts
+	return podtracerOpts, nil
 }
 
 func (r *SnoopyJobReconciler) getRunningPodsByLabel(ctx context.Context, label map[string]string, namespace string) (*corev1.PodList, error) {
@@ -188,8 +377,8 @@ func (r *SnoopyJobReconciler) getRunningPodsByLabel(ctx context.Context, label m
 	podlist := &corev1.PodList{}
 	listOpts := []client.ListOption{
 		client.MatchingLabels(label),
+		client.MatchingFields{podPhaseField: string(corev1.PodRunning)},
 		client.InNamespace(namespace),
-		// client.MatchingFields{"phase": "Running"}, // TODO: TSHOOT contantly returning status.phase doesn't exist...
 	}
 
 	err := r.Client.List(ctx, podlist, listOpts...)
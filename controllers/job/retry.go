@@ -0,0 +1,278 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// targetAttempt returns the attempt the run of a target is at.
+func targetAttempt(snoopyJob *jobv1alpha1.SnoopyJob, targetName string) int32 {
+	for _, outcome := range snoopyJob.Status.Outcomes {
+		if outcome.Target == targetName && outcome.Attempts > 1 {
+			return outcome.Attempts
+		}
+	}
+	return 1
+}
+
+func maxAttempts(retryPolicy *jobv1alpha1.RetryPolicy) int32 {
+	if retryPolicy.MaxAttempts < 1 {
+		return 1
+	}
+	return retryPolicy.MaxAttempts
+}
+
+// retryBackoff returns the delay after a failed attempt, doubled at each attempt.
+func retryBackoff(retryPolicy *jobv1alpha1.RetryPolicy, attempt int32) time.Duration {
+
+	backoff := defaultRetryBackoff
+	if retryPolicy.Backoff != nil {
+		backoff = retryPolicy.Backoff.Duration
+	}
+
+	for i := int32(1); i < attempt && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+
+	return backoff
+}
+
+// reconcileOutcomes records the outcome of the latest run of each target and
+// starts the next attempt of failed runs once their backoff has passed. It
+// returns how long until the next pending attempt, zero when there is none.
+func (r *SnoopyJobReconciler) reconcileOutcomes(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, workers *corev1.PodList) (time.Duration, error) {
+
+	// Keep the most recent worker Pod per target.
+	latest := map[string]*corev1.Pod{}
+	targets := []string{}
+	for i := range workers.Items {
+		pod := &workers.Items[i]
+		target := pod.Labels[snoopyTargetLabel]
+		if _, found := latest[target]; !found {
+			targets = append(targets, target)
+		}
+		latest[target] = pod
+	}
+
+	previous := map[string]jobv1alpha1.TargetOutcome{}
+	for _, outcome := range snoopyJob.Status.Outcomes {
+		previous[outcome.Target] = outcome
+	}
+
+	// Only one-shot runs are retried by the operator.
+	retryPolicy := snoopyJob.Spec.RetryPolicy
+	retries := retryPolicy != nil && snoopyJob.Spec.Schedule == ""
+
+	var nextAttempt time.Duration
+	outcomes := []jobv1alpha1.TargetOutcome{}
+	for _, target := range targets {
+		pod := latest[target]
+
+		// Outcomes of plain first attempts are not kept in the status.
+		outcome, found := previous[target]
+		if !found {
+			outcome = jobv1alpha1.TargetOutcome{Target: target, Attempts: podAttempt(pod)}
+		}
+
+		// The worker of the current attempt has not shown up or finished yet.
+		if podAttempt(pod) < outcome.Attempts || (pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed) {
+			outcome.Outcome = jobv1alpha1.TargetRunning
+			outcome.NextAttemptTime = nil
+			outcome.Message = ""
+			outcomes = append(outcomes, outcome)
+			continue
+		}
+
+		stepOutcome, message, err := r.podOutcome(ctx, snoopyJob, pod)
+		if err != nil {
+			return 0, err
+		}
+		outcome.Message = message
+		outcome.NextAttemptTime = nil
+
+		switch {
+		case stepOutcome == jobv1alpha1.StepOutcomeSuccess:
+			outcome.Outcome = jobv1alpha1.TargetSucceeded
+
+		case stepOutcome == jobv1alpha1.StepOutcomeRetry && retries && outcome.Attempts < maxAttempts(retryPolicy):
+			finished := pod.CreationTimestamp.Time
+			if completion := podCompletionTime(pod); completion != nil {
+				finished = completion.Time
+			}
+			next := finished.Add(retryBackoff(retryPolicy, outcome.Attempts))
+
+			if wait := time.Until(next); wait > 0 {
+				outcome.Outcome = jobv1alpha1.TargetRetrying
+				outcome.NextAttemptTime = &metav1.Time{Time: next}
+				if nextAttempt == 0 || wait < nextAttempt {
+					nextAttempt = wait
+				}
+			} else {
+				// The Job of the next attempt is created on the following reconcile.
+				outcome.Attempts++
+				outcome.Outcome = jobv1alpha1.TargetRunning
+				outcome.Message = ""
+				nextAttempt = time.Second
+			}
+
+		default:
+			outcome.Outcome = jobv1alpha1.TargetFailed
+		}
+
+		outcomes = append(outcomes, outcome)
+	}
+
+	// Keep the outcomes of targets whose worker Pods are gone.
+	for _, outcome := range snoopyJob.Status.Outcomes {
+		if _, found := latest[outcome.Target]; !found {
+			outcomes = append(outcomes, outcome)
+		}
+	}
+
+	// Updating Status.
+	snoopyJob.Status.Outcomes = outcomes
+	snoopyJob.Status.TargetCounts = countOutcomes(outcomes)
+	return nextAttempt, nil
+}
+
+// podAttempt returns the attempt a worker Pod runs.
+func podAttempt(pod *corev1.Pod) int32 {
+	attempt, err := strconv.ParseInt(pod.Labels[snoopyAttemptLabel], 10, 32)
+	if err != nil || attempt < 1 {
+		return 1
+	}
+	return int32(attempt)
+}
+
+// podOutcome returns the outcome of a finished worker Pod, the worst outcome
+// of its steps, with a message explaining failures.
+func (r *SnoopyJobReconciler) podOutcome(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, pod *corev1.Pod) (jobv1alpha1.StepOutcome, string, error) {
+
+	podOutcome := jobv1alpha1.StepOutcomeSuccess
+	message := ""
+	ended := false
+
+	for _, step := range jobSteps(snoopyJob) {
+		result := stepResult(pod, step)
+		if result.ExitCode == nil {
+			continue
+		}
+		ended = true
+
+		outcome, err := r.stepOutcome(ctx, snoopyJob, pod, step, result)
+		if err != nil {
+			return "", "", err
+		}
+
+		if outcomeSeverity(outcome) > outcomeSeverity(podOutcome) {
+			podOutcome = outcome
+			message = fmt.Sprintf("step %s exited with %d", step.Name, *result.ExitCode)
+			if result.Message != "" {
+				message += ": " + result.Message
+			}
+		}
+	}
+
+	// Pods failing before any step ended, evicted or out of time, are retried.
+	if !ended && pod.Status.Phase == corev1.PodFailed {
+		return jobv1alpha1.StepOutcomeRetry, pod.Status.Reason, nil
+	}
+
+	return podOutcome, message, nil
+}
+
+// stepOutcome applies the exit code rules of a SnoopyJob to a finished step.
+func (r *SnoopyJobReconciler) stepOutcome(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, pod *corev1.Pod, step jobv1alpha1.Step, result jobv1alpha1.StepResult) (jobv1alpha1.StepOutcome, error) {
+
+	var output []byte
+	for _, rule := range snoopyJob.Spec.ExitCodeRules {
+		if rule.Step != "" && rule.Step != step.Name {
+			continue
+		}
+		if len(rule.ExitCodes) > 0 && !containsExitCode(rule.ExitCodes, *result.ExitCode) {
+			continue
+		}
+
+		if rule.OutputPattern != "" {
+			pattern, err := regexp.Compile(rule.OutputPattern)
+			if err != nil {
+				return "", err
+			}
+			if output == nil {
+				if output, err = r.stepOutput(ctx, pod, step); err != nil {
+					return "", err
+				}
+			}
+			if !pattern.Match(output) {
+				continue
+			}
+		}
+
+		return rule.Outcome, nil
+	}
+
+	if *result.ExitCode == 0 || step.ContinueOnError || result.StopReason != "" {
+		return jobv1alpha1.StepOutcomeSuccess, nil
+	}
+
+	return jobv1alpha1.StepOutcomeRetry, nil
+}
+
+// stepOutput returns the last lines of the output of a step.
+func (r *SnoopyJobReconciler) stepOutput(ctx context.Context, pod *corev1.Pod, step jobv1alpha1.Step) ([]byte, error) {
+
+	tailLines := int64(outcomeLogLines)
+	output, err := r.Clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: step.Name,
+		TailLines: &tailLines,
+	}).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+func containsExitCode(exitCodes []int32, exitCode int32) bool {
+	for _, code := range exitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// outcomeSeverity orders step outcomes from the best to the worst.
+func outcomeSeverity(outcome jobv1alpha1.StepOutcome) int {
+	switch outcome {
+	case jobv1alpha1.StepOutcomeSuccess:
+		return 0
+	case jobv1alpha1.StepOutcomeRetry:
+		return 1
+	case jobv1alpha1.StepOutcomePermanentFailure:
+		return 2
+	}
+	return 1
+}
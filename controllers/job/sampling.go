@@ -0,0 +1,136 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// sampleTargets picks the Pod targets to run against according to the
+// SnoopyJob sampling. Previously sampled Pods still present are kept first,
+// free slots are filled in the sampling mode order. Node targets are kept as is.
+func sampleTargets(snoopyJob *jobv1alpha1.SnoopyJob, targets []target, previous map[string]bool) []target {
+
+	sampling := snoopyJob.Spec.Sampling
+	if sampling == nil {
+		return targets
+	}
+
+	sampled := []target{}
+	candidates := []target{}
+	for _, target := range targets {
+		if target.host {
+			sampled = append(sampled, target)
+		} else {
+			candidates = append(candidates, target)
+		}
+	}
+
+	quota := len(candidates)
+	if sampling.Count != nil && int(*sampling.Count) < quota {
+		quota = int(*sampling.Count)
+	}
+	if sampling.Percentage != nil {
+		if byPercentage := (len(candidates)*int(*sampling.Percentage) + 99) / 100; byPercentage < quota {
+			quota = byPercentage
+		}
+	}
+
+	switch sampling.Mode {
+	case jobv1alpha1.DeterministicSampling:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return samplingHash(snoopyJob, candidates[i]) < samplingHash(snoopyJob, candidates[j])
+		})
+	case jobv1alpha1.RandomSampling:
+		fallthrough
+	default:
+		// Sampling doesn't need a cryptographically secure source.
+		rand.Shuffle(len(candidates), func(i, j int) { //nolint:gosec
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return previous[candidates[i].name] && !previous[candidates[j].name]
+	})
+
+	perNode := map[string]int32{}
+	picked := 0
+	for _, candidate := range candidates {
+		if picked == quota {
+			break
+		}
+		if sampling.MaxPerNode != nil && perNode[candidate.nodeName] >= *sampling.MaxPerNode {
+			continue
+		}
+		perNode[candidate.nodeName]++
+		picked++
+		sampled = append(sampled, candidate)
+	}
+
+	return sampled
+}
+
+// previouslySampled returns the Pods sampled before, those listed in the
+// status and, as the list is bounded, those the workers run against.
+func (r *SnoopyJobReconciler) previouslySampled(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob) (map[string]bool, error) {
+
+	previous := map[string]bool{}
+	for _, name := range snoopyJob.Status.SampledTargets {
+		previous[name] = true
+	}
+
+	if snoopyJob.Spec.Schedule != "" {
+		cronJobs, err := r.listCronJobs(ctx, snoopyJob)
+		if err != nil {
+			return nil, err
+		}
+		for _, cronJob := range cronJobs.Items {
+			previous[cronJob.Spec.JobTemplate.Spec.Template.Labels[snoopyTargetLabel]] = true
+		}
+		return previous, nil
+	}
+
+	jobs, err := r.listJobs(ctx, snoopyJob)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs.Items {
+		previous[job.Spec.Template.Labels[snoopyTargetLabel]] = true
+	}
+	return previous, nil
+}
+
+// samplingHash orders targets in a stable way for a given SnoopyJob.
+func samplingHash(snoopyJob *jobv1alpha1.SnoopyJob, target target) uint32 {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(snoopyJob.Namespace + "/" + snoopyJob.Name + "/" + target.name))
+	return hash.Sum32()
+}
+
+// sampledTargetNames lists the names of the sampled Pod targets.
+func sampledTargetNames(targets []target) []string {
+	names := []string{}
+	for _, target := range targets {
+		if !target.host {
+			names = append(names, target.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,223 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	apimachinery "k8s.io/apimachinery/pkg/types"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// The benchmarks below are smoke benchmarks of the reconciler with 5,000
+// targets over the fake client. It ignores field selectors and lacks
+// server-side apply, so they neither exercise the cache indexes nor the
+// apply path of a real API server. They show the reconciler copes with that
+// many targets and that the status stays bounded.
+const benchmarkTargets = 5000
+
+// applyClient stands in for server-side apply, which the fake client lacks,
+// by creating the applied object.
+type applyClient struct {
+	client.Client
+}
+
+func (c applyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() != apimachinery.ApplyPatchType {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+	return c.Client.Create(ctx, obj)
+}
+
+// newBenchmarkReconciler returns a reconciler over a SnoopyJob selecting
+// the given number of running Pods.
+func newBenchmarkReconciler(b *testing.B, targets int) (*SnoopyJobReconciler, ctrl.Request) {
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		b.Fatal(err)
+	}
+	if err := jobv1alpha1.AddToScheme(scheme); err != nil {
+		b.Fatal(err)
+	}
+
+	objects := []client.Object{&jobv1alpha1.SnoopyJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "capture", Namespace: "snoopy-operator"},
+		Spec: jobv1alpha1.SnoopyJobSpec{
+			Command:         "tcpdump",
+			Args:            "-i eth0 host {{ .Pod.IP }}",
+			LabelSelector:   map[string]string{"app": "fleet"},
+			TargetNamespace: "fleet",
+			Timer:           "1m",
+			RetryPolicy:     &jobv1alpha1.RetryPolicy{MaxAttempts: 3},
+			Output: &jobv1alpha1.Output{
+				Type:                  jobv1alpha1.PersistentVolumeClaimSink,
+				PersistentVolumeClaim: &jobv1alpha1.PersistentVolumeClaimOutput{ClaimName: "captures"},
+			},
+		},
+	}}
+	for i := 0; i < targets; i++ {
+		objects = append(objects, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("fleet-%d", i),
+				Namespace: "fleet",
+				Labels:    map[string]string{"app": "fleet"},
+			},
+			Spec:   corev1.PodSpec{NodeName: fmt.Sprintf("node-%d", i%100)},
+			Status: corev1.PodStatus{Phase: corev1.PodRunning, PodIP: fmt.Sprintf("10.0.%d.%d", i/250, i%250)},
+		})
+	}
+
+	// Writing to a claim takes the wrapper script.
+	r := &SnoopyJobReconciler{
+		Client:            applyClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()},
+		Scheme:            scheme,
+		Clientset:         kubernetesfake.NewSimpleClientset(),
+		PodtracerFeatures: []string{featureShell},
+	}
+
+	return r, ctrl.Request{NamespacedName: apimachinery.NamespacedName{Namespace: "snoopy-operator", Name: "capture"}}
+}
+
+// finishWorkers creates a finished worker Pod per target, one in ten of them
+// failed.
+func finishWorkers(b *testing.B, r *SnoopyJobReconciler, targets int) {
+
+	ctx := context.Background()
+	finishedAt := metav1.NewTime(time.Now())
+	for i := 0; i < targets; i++ {
+		phase := corev1.PodSucceeded
+		exitCode := int32(0)
+		if i%10 == 0 {
+			phase = corev1.PodFailed
+			exitCode = 1
+		}
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("snoopy-job-snoopy-operator.capture-fleet-%d-worker", i),
+				Namespace: "snoopy-operator",
+				Labels: map[string]string{
+					snoopyJobLabel:          "capture",
+					snoopyJobNamespaceLabel: "snoopy-operator",
+					snoopyTargetLabel:       fmt.Sprintf("fleet-%d", i),
+					snoopyAttemptLabel:      "1",
+				},
+				Annotations: map[string]string{outputDirAnnotation: fmt.Sprintf("fleet/fleet-%d", i)},
+			},
+			Status: corev1.PodStatus{
+				Phase: phase,
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name: defaultStepName,
+					State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+						ExitCode:   exitCode,
+						StartedAt:  finishedAt,
+						FinishedAt: finishedAt,
+					}},
+				}},
+			},
+		}
+		if err := r.Client.Create(ctx, pod); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReconcileCreate measures the first reconcile of a SnoopyJob with
+// 5,000 targets, which creates one Job per target.
+func BenchmarkReconcileCreate(b *testing.B) {
+
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		r, req := newBenchmarkReconciler(b, benchmarkTargets)
+		b.StartTimer()
+
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		jobs := &batchv1.JobList{}
+		if err := r.Client.List(ctx, jobs, client.InNamespace("snoopy-operator")); err != nil {
+			b.Fatal(err)
+		}
+		if len(jobs.Items) != benchmarkTargets {
+			b.Fatalf("got %d jobs, want %d", len(jobs.Items), benchmarkTargets)
+		}
+	}
+}
+
+// BenchmarkReconcileSteady measures the reconciles of a SnoopyJob with
+// 5,000 targets once its Jobs exist and their worker Pods finished, and
+// checks the status stays well below the object size limit.
+func BenchmarkReconcileSteady(b *testing.B) {
+
+	ctx := context.Background()
+	r, req := newBenchmarkReconciler(b, benchmarkTargets)
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		b.Fatal(err)
+	}
+	finishWorkers(b, r, benchmarkTargets)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	snoopyJob := &jobv1alpha1.SnoopyJob{}
+	if err := r.Client.Get(ctx, req.NamespacedName, snoopyJob); err != nil {
+		b.Fatal(err)
+	}
+	if snoopyJob.Status.Workers != benchmarkTargets {
+		b.Fatalf("got %d workers in status, want %d", snoopyJob.Status.Workers, benchmarkTargets)
+	}
+
+	counts := snoopyJob.Status.TargetCounts
+	if counts == nil || counts.Succeeded != benchmarkTargets*9/10 || counts.Retrying != benchmarkTargets/10 {
+		b.Fatalf("got target counts %+v, want %d succeeded and %d retrying", counts, benchmarkTargets*9/10, benchmarkTargets/10)
+	}
+	if len(snoopyJob.Status.Artifacts) != maxStatusEntries {
+		b.Fatalf("got %d artifacts in status, want %d", len(snoopyJob.Status.Artifacts), maxStatusEntries)
+	}
+	if recorded := len(snoopyJob.Status.Artifacts) + int(snoopyJob.Status.PrunedArtifacts); recorded != benchmarkTargets {
+		b.Fatalf("got %d artifacts recorded, want %d", recorded, benchmarkTargets)
+	}
+
+	status, err := json.Marshal(snoopyJob.Status)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if len(status) > 256*1024 {
+		b.Fatalf("got a status of %d bytes, want at most %d", len(status), 256*1024)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	apimachinery "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// SnoopyConnectivityCheckReconciler reconciles a SnoopyConnectivityCheck object.
+// The probes run as the steps of a SnoopyJob owned by the check.
+type SnoopyConnectivityCheckReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Clientset reads the probe output from the worker Pod logs.
+	Clientset kubernetes.Interface
+
+	// MaxConcurrentReconciles is how many checks are reconciled at once. Defaults to 1.
+	MaxConcurrentReconciles int
+}
+
+//+kubebuilder:rbac:groups=job.fennecproject.io,resources=snoopyconnectivitychecks,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=job.fennecproject.io,resources=snoopyconnectivitychecks/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=job.fennecproject.io,resources=snoopyconnectivitychecks/finalizers,verbs=update
+
+// Reconcile keeps the SnoopyJob running the probes in line with the check
+// and collects the results of its latest runs.
+func (r *SnoopyConnectivityCheckReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	Log := log.FromContext(ctx).WithValues("method", "reconcile")
+
+	check := &jobv1alpha1.SnoopyConnectivityCheck{}
+	err := r.Client.Get(ctx, req.NamespacedName, check)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		Log.Error(err, "Error requesting SnoopyConnectivityCheck")
+		return ctrl.Result{}, err
+	}
+
+	original := check.Status.DeepCopy()
+
+	// The spec has to change before the check can run.
+	if err := validateDestinations(check); err != nil {
+		Log.Info("Invalid destinations for SnoopyConnectivityCheck", "error", err.Error())
+		check.Status.Message = err.Error()
+		return ctrl.Result{}, r.updateStatus(ctx, check, original)
+	}
+
+	probes, err := r.resolveProbes(ctx, check)
+	if err != nil {
+		Log.Error(err, "Error resolving destinations for SnoopyConnectivityCheck")
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	// A SnoopyJob without steps would fall back to running an empty
+	// command, so there is none until a destination resolves.
+	if len(probes) == 0 {
+		if err := r.deleteProbeJob(ctx, check); err != nil {
+			Log.Error(err, "Error deleting SnoopyJob for SnoopyConnectivityCheck")
+			return ctrl.Result{Requeue: true}, err
+		}
+		// Updating Status.
+		check.Status.SnoopyJob = ""
+		check.Status.Message = "no destinations"
+		if err := r.updateStatus(ctx, check, original); err != nil {
+			return ctrl.Result{Requeue: true}, err
+		}
+		return ctrl.Result{RequeueAfter: probeResolvePeriod}, nil
+	}
+
+	snoopyJob, err := r.reconcileProbeJob(ctx, check, probes)
+	if err != nil {
+		Log.Error(err, "Error reconciling SnoopyJob for SnoopyConnectivityCheck")
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	results, err := r.collectResults(ctx, check, snoopyJob)
+	if err != nil {
+		Log.Error(err, "Error collecting results for SnoopyConnectivityCheck")
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	// Updating Status.
+	check.Status.SnoopyJob = snoopyJob.Name
+	check.Status.Results = results
+	check.Status.Message = ""
+	if snoopyJob.Status.Phase == jobv1alpha1.SnoopyJobRejected {
+		check.Status.Message = snoopyJob.Status.Message
+	}
+	if err := r.updateStatus(ctx, check, original); err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	// Destination Pods come and go, so resolve them again from time to time.
+	return ctrl.Result{RequeueAfter: probeResolvePeriod}, nil
+}
+
+// updateStatus writes the status of a check when it changed.
+func (r *SnoopyConnectivityCheckReconciler) updateStatus(ctx context.Context, check *jobv1alpha1.SnoopyConnectivityCheck, original *jobv1alpha1.SnoopyConnectivityCheckStatus) error {
+
+	if equality.Semantic.DeepEqual(original, &check.Status) {
+		return nil
+	}
+
+	if err := r.Client.Status().Update(ctx, check); err != nil {
+		log.FromContext(ctx).Error(err, "Error updating SnoopyConnectivityCheck status")
+		return err
+	}
+	return nil
+}
+
+// deleteProbeJob deletes the SnoopyJob of a check, if there is one.
+func (r *SnoopyConnectivityCheckReconciler) deleteProbeJob(ctx context.Context, check *jobv1alpha1.SnoopyConnectivityCheck) error {
+
+	snoopyJob := &jobv1alpha1.SnoopyJob{}
+	err := r.Client.Get(ctx, apimachinery.NamespacedName{Namespace: check.Namespace, Name: check.Name + "-probes"}, snoopyJob)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !metav1.IsControlledBy(snoopyJob, check) {
+		return nil
+	}
+
+	if err := r.Client.Delete(ctx, snoopyJob); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// reconcileProbeJob creates or updates the SnoopyJob running the probes of a check.
+func (r *SnoopyConnectivityCheckReconciler) reconcileProbeJob(ctx context.Context, check *jobv1alpha1.SnoopyConnectivityCheck, probes []probe) (*jobv1alpha1.SnoopyJob, error) {
+
+	encodedProbes, err := json.Marshal(probes)
+	if err != nil {
+		return nil, err
+	}
+
+	desired := &jobv1alpha1.SnoopyJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        check.Name + "-probes",
+			Namespace:   check.Namespace,
+			Annotations: map[string]string{probesAnnotation: string(encodedProbes)},
+		},
+		Spec: jobv1alpha1.SnoopyJobSpec{
+			LabelSelector:   check.Spec.Source.LabelSelector,
+			TargetNamespace: check.Spec.Source.Namespace,
+			Schedule:        check.Spec.Schedule,
+			Steps:           probeSteps(check.Spec.Probe, probes),
+		},
+	}
+	if err := ctrl.SetControllerReference(check, desired, r.Scheme); err != nil {
+		return nil, err
+	}
+
+	snoopyJob := &jobv1alpha1.SnoopyJob{}
+	err = r.Client.Get(ctx, apimachinery.NamespacedName{Namespace: desired.Namespace, Name: desired.Name}, snoopyJob)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return desired, r.Client.Create(ctx, desired)
+		}
+		return nil, err
+	}
+
+	if equality.Semantic.DeepEqual(snoopyJob.Spec, desired.Spec) && snoopyJob.Annotations[probesAnnotation] == desired.Annotations[probesAnnotation] {
+		return snoopyJob, nil
+	}
+
+	snoopyJob.Spec = desired.Spec
+	if snoopyJob.Annotations == nil {
+		snoopyJob.Annotations = map[string]string{}
+	}
+	snoopyJob.Annotations[probesAnnotation] = desired.Annotations[probesAnnotation]
+	return snoopyJob, r.Client.Update(ctx, snoopyJob)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *SnoopyConnectivityCheckReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	maxConcurrentReconciles := r.MaxConcurrentReconciles
+	if maxConcurrentReconciles < 1 {
+		maxConcurrentReconciles = 1
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&jobv1alpha1.SnoopyConnectivityCheck{}).
+		Owns(&jobv1alpha1.SnoopyJob{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: maxConcurrentReconciles}).
+		Complete(r)
+}
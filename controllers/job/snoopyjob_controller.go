@@ -16,14 +16,22 @@ package job
 
 import (
 	"context"
+	"time"
 
 	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
 )
@@ -32,6 +40,19 @@ import (
 type SnoopyJobReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// Clientset reads worker Pod logs for the ConfigMap output sink.
+	Clientset kubernetes.Interface
+
+	// MaxConcurrentReconciles is how many SnoopyJobs are reconciled at once. Defaults to 1.
+	MaxConcurrentReconciles int
+
+	// PodtracerImage is the image worker Pods run. Defaults to the pinned podtracer release.
+	PodtracerImage string
+
+	// PodtracerFeatures lists what PodtracerImage supports beyond the pinned
+	// release, see podtracer.go.
+	PodtracerFeatures []string
 }
 
 //+kubebuilder:rbac:groups=job.fennecproject.io,resources=snoopyjobs,verbs=get;list;watch;create;update;patch;delete
@@ -39,9 +60,14 @@ type SnoopyJobReconciler struct {
 //+kubebuilder:rbac:groups=job.fennecproject.io,resources=snoopyjobs/finalizers,verbs=update
 //+kubebuilder:rbac:groups=batch,resources=jobs;cronjobs,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=configmaps;pods,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=pods/log,verbs=get
+//+kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
+//+kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=deployments;replicasets;statefulsets;daemonsets,verbs=get;list;watch
 //+kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=data.fennecproject.io,resources=snoopydataendpoints,verbs=get;list;watch
 
-func (r *SnoopyJobReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *SnoopyJobReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
 	Log := log.FromContext(ctx).WithValues("method", "reconcile")
 
 	Log.V(2).Info("Initiating reconciliation...")
@@ -49,7 +75,7 @@ func (r *SnoopyJobReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	snoopyJob := &jobv1alpha1.SnoopyJob{}
 	Log.V(2).Info("Looking for snoopyJob CRs")
 
-	err := r.Client.Get(ctx, req.NamespacedName, snoopyJob)
+	err = r.Client.Get(ctx, req.NamespacedName, snoopyJob)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			return ctrl.Result{}, nil
@@ -58,42 +84,212 @@ func (r *SnoopyJobReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return ctrl.Result{}, err
 	}
 
+	// Leases are left for the SnoopyJob to delete, see leases.go.
+	if !snoopyJob.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(snoopyJob, leaseFinalizer) {
+			return ctrl.Result{}, nil
+		}
+		if err = r.releaseAllTargets(ctx, snoopyJob); err != nil {
+			Log.Error(err, "Error releasing the targets of SnoopyJob")
+			return ctrl.Result{Requeue: true}, err
+		}
+		controllerutil.RemoveFinalizer(snoopyJob, leaseFinalizer)
+		return ctrl.Result{}, r.Client.Update(ctx, snoopyJob)
+	}
+	if !controllerutil.ContainsFinalizer(snoopyJob, leaseFinalizer) {
+		controllerutil.AddFinalizer(snoopyJob, leaseFinalizer)
+		if err = r.Client.Update(ctx, snoopyJob); err != nil {
+			Log.Error(err, "Error adding finalizer to SnoopyJob")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// The status is built up in memory and written once, whatever happens.
+	original := snoopyJob.DeepCopy()
+	defer func() {
+		if patchErr := r.patchStatus(ctx, original, snoopyJob); patchErr != nil {
+			Log.Error(patchErr, "Error updating SnoopyJob status")
+			if err == nil {
+				result, err = ctrl.Result{Requeue: true}, patchErr
+			}
+		}
+	}()
+
+	// A dry run only renders what would be created.
+	if snoopyJob.Spec.DryRun {
+		if err = r.reconcileDryRun(ctx, snoopyJob); err != nil {
+			Log.Error(err, "Error rendering dry run for SnoopyJob")
+			return ctrl.Result{Requeue: true}, err
+		}
+		Log.Info("Dry run for SnoopyJob rendered", "configMap", snoopyJob.Status.DryRunConfigMap)
+		return ctrl.Result{}, nil
+	}
+
+	// A stopped SnoopyJob only winds down what is still running.
+	if snoopyJob.Spec.Stop {
+		if err = r.reconcileStop(ctx, snoopyJob); err != nil {
+			Log.Error(err, "Error stopping SnoopyJob")
+			return ctrl.Result{Requeue: true}, err
+		}
+		Log.Info("SnoopyJob stopped")
+		return ctrl.Result{}, nil
+	}
+
+	// Nothing is created for a SnoopyJob the workers could not run.
+	if r.rejectUnsupported(snoopyJob) {
+		Log.Info("SnoopyJob rejected", "message", snoopyJob.Status.Message)
+		return ctrl.Result{}, nil
+	}
+
+	var existingCronJobs *batchv1.CronJobList
 	if snoopyJob.Spec.Schedule != "" {
+		if existingCronJobs, err = r.listCronJobs(ctx, snoopyJob); err != nil {
+			Log.Error(err, "Error listing cronJobs for SnoopyJob")
+			return ctrl.Result{Requeue: true}, err
+		}
+		countScheduledRuns(snoopyJob, existingCronJobs)
+	}
+
+	// Only run inside the activation window and come back at its next boundary.
+	phase, nextBoundary := activationWindow(snoopyJob, time.Now())
+	snoopyJob.Status.Phase = phase
+
+	switch {
+	case phase == jobv1alpha1.SnoopyJobPending:
+		Log.Info("SnoopyJob not active yet", "activeFrom", snoopyJob.Spec.ActiveFrom)
+		return ctrl.Result{RequeueAfter: nextBoundary}, nil
+
+	case phase == jobv1alpha1.SnoopyJobExpired && snoopyJob.Spec.Schedule != "":
+		if err = r.suspendCronJobs(ctx, existingCronJobs, true); err != nil {
+			Log.Error(err, "Error suspending cronJobs for SnoopyJob")
+			return ctrl.Result{Requeue: true}, err
+		}
+		Log.Info("SnoopyJob expired, cronJobs suspended")
+
+	case phase == jobv1alpha1.SnoopyJobExpired:
+		Log.Info("SnoopyJob expired")
+
+	case snoopyJob.Spec.Schedule != "":
+		if err = r.suspendCronJobs(ctx, existingCronJobs, false); err != nil {
+			Log.Error(err, "Error resuming cronJobs for SnoopyJob")
+			return ctrl.Result{Requeue: true}, err
+		}
 
-		cronJobs, err := r.buildCronJobForPods(snoopyJob)
+		cronJobs, err := r.buildCronJobForTargets(snoopyJob)
 		if err != nil {
 			Log.Error(err, "Error building cronJob for SnoopyJob")
 			return ctrl.Result{Requeue: true}, err
 		}
 		Log.Info("Creating CronJob for SnoopyJob")
-		if err = r.reconcileCronJobs(snoopyJob, cronJobs); err != nil {
+		if err = r.reconcileCronJobs(ctx, snoopyJob, existingCronJobs, cronJobs); err != nil {
 			Log.Error(err, "Error reconciling cronJob for SnoopyJob")
 			return ctrl.Result{Requeue: true}, err
 		}
 		Log.Info("CronJob for SnoopyJob created successfully")
-	} else {
 
-		jobs, err := r.buildJobForPods(snoopyJob)
+	default:
+		jobs, err := r.buildJobForTargets(snoopyJob)
 		if err != nil {
 			Log.Error(err, "Error building Job for SnoopyJob")
 			return ctrl.Result{Requeue: true}, err
 		}
 		Log.Info("Creating Job for SnoopyJob")
-		if err = r.reconcileJobs(snoopyJob, jobs); err != nil {
+		if err = r.reconcileJobs(ctx, snoopyJob, jobs); err != nil {
 			Log.Error(err, "Error reconciling Job for SnoopyJob")
 			return ctrl.Result{Requeue: true}, err
 		}
 		Log.Info("Job for SnoopyJob created successfully")
 	}
-	return ctrl.Result{Requeue: false}, nil
+
+	workers, err := r.listWorkerPods(ctx, snoopyJob)
+	if err != nil {
+		Log.Error(err, "Error listing worker Pods for SnoopyJob")
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	if err = r.reconcileTargetConditions(ctx, snoopyJob, workers); err != nil {
+		Log.Error(err, "Error stopping workers on target condition for SnoopyJob")
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	nextStartCheck, err := r.reconcileSynchronizedStart(ctx, snoopyJob, workers)
+	if err != nil {
+		Log.Error(err, "Error synchronizing the start of workers for SnoopyJob")
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	// Worker Pods are not watched, so keep polling while steps are running.
+	unfinished := reconcileStepResults(snoopyJob, workers)
+
+	nextAttempt, err := r.reconcileOutcomes(ctx, snoopyJob, workers)
+	if err != nil {
+		Log.Error(err, "Error updating target outcomes for SnoopyJob")
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	if err = r.reconcileArtifacts(ctx, snoopyJob, workers); err != nil {
+		Log.Error(err, "Error recording output artifacts for SnoopyJob")
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	if err = r.releaseTargets(ctx, snoopyJob); err != nil {
+		Log.Error(err, "Error releasing targets of SnoopyJob")
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	// Queued targets are checked again until the SnoopyJob holding them is done.
+	if hasQueuedTargets(snoopyJob) {
+		Log.Info("Targets of SnoopyJob queued behind other SnoopyJobs", "conflicts", snoopyJob.Status.Conflicts)
+		unfinished = true
+	}
+
+	// Come back for the next attempt of failed runs.
+	if nextAttempt > 0 && (nextBoundary == 0 || nextAttempt < nextBoundary) {
+		nextBoundary = nextAttempt
+	}
+
+	// Workers waiting for a synchronized start are checked more often.
+	if nextStartCheck > 0 && (nextBoundary == 0 || nextStartCheck < nextBoundary) {
+		nextBoundary = nextStartCheck
+	}
+
+	if unfinished && (nextBoundary == 0 || stepResultsPollInterval < nextBoundary) {
+		return ctrl.Result{RequeueAfter: stepResultsPollInterval}, nil
+	}
+
+	return ctrl.Result{RequeueAfter: nextBoundary}, nil
+}
+
+// patchStatus writes the status of a SnoopyJob in a single merge patch when it changed.
+func (r *SnoopyJobReconciler) patchStatus(ctx context.Context, original *jobv1alpha1.SnoopyJob, snoopyJob *jobv1alpha1.SnoopyJob) error {
+
+	compactStatus(&snoopyJob.Status)
+
+	if equality.Semantic.DeepEqual(original.Status, snoopyJob.Status) {
+		return nil
+	}
+
+	return r.Client.Status().Patch(ctx, snoopyJob, client.MergeFrom(original))
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *SnoopyJobReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	if err := setupIndexes(context.Background(), mgr.GetFieldIndexer()); err != nil {
+		return err
+	}
+
+	maxConcurrentReconciles := r.MaxConcurrentReconciles
+	if maxConcurrentReconciles < 1 {
+		maxConcurrentReconciles = 1
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&jobv1alpha1.SnoopyJob{}).
 		Owns(&batchv1.CronJob{}).
 		Owns(&batchv1.Job{}).
-		WithOptions(controller.Options{MaxConcurrentReconciles: 1}).
+		Owns(&corev1.ConfigMap{}).
+		Watches(&source.Kind{Type: &discoveryv1.EndpointSlice{}}, handler.EnqueueRequestsFromMapFunc(r.snoopyJobsForEndpointSlice)).
+		WithOptions(controller.Options{MaxConcurrentReconciles: maxConcurrentReconciles}).
 		Complete(r)
 }
@@ -0,0 +1,192 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// jobSteps returns the steps run by a SnoopyJob. A SnoopyJob without steps
+// runs its Command as a single step.
+func jobSteps(snoopyJob *jobv1alpha1.SnoopyJob) []jobv1alpha1.Step {
+
+	if len(snoopyJob.Spec.Steps) > 0 {
+		return snoopyJob.Spec.Steps
+	}
+
+	return []jobv1alpha1.Step{{
+		Name:    defaultStepName,
+		Command: snoopyJob.Spec.Command,
+		Args:    snoopyJob.Spec.Args,
+	}}
+}
+
+// listWorkerPods lists the worker Pods of a SnoopyJob, oldest first.
+func (r *SnoopyJobReconciler) listWorkerPods(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob) (*corev1.PodList, error) {
+
+	podlist := &corev1.PodList{}
+	listOpts := []client.ListOption{
+		client.MatchingLabels(snoopyJobLabels(snoopyJob)),
+		client.MatchingFields{snoopyJobField: snoopyJobKey(snoopyJob.Namespace, snoopyJob.Name)},
+		client.InNamespace("snoopy-operator"),
+	}
+	if err := r.Client.List(ctx, podlist, listOpts...); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(podlist.Items, func(i, j int) bool {
+		return podlist.Items[i].CreationTimestamp.Before(&podlist.Items[j].CreationTimestamp)
+	})
+
+	return podlist, nil
+}
+
+// reconcileStepResults reads the step results from the latest worker Pod of
+// each target and records them in the SnoopyJob status. It returns true while
+// some step has not finished yet.
+func reconcileStepResults(snoopyJob *jobv1alpha1.SnoopyJob, workers *corev1.PodList) bool {
+
+	// Keep the most recent worker Pod per target.
+	latest := map[string]*corev1.Pod{}
+	targets := []string{}
+	for i := range workers.Items {
+		pod := &workers.Items[i]
+		target := pod.Labels[snoopyTargetLabel]
+		if _, found := latest[target]; !found {
+			targets = append(targets, target)
+		}
+		latest[target] = pod
+	}
+
+	unfinished := false
+	results := []jobv1alpha1.StepResult{}
+	for _, target := range targets {
+		for _, step := range jobSteps(snoopyJob) {
+			result := stepResult(latest[target], step)
+			if result.Phase == jobv1alpha1.StepPending || result.Phase == jobv1alpha1.StepRunning {
+				unfinished = true
+			}
+			results = append(results, result)
+		}
+	}
+
+	// Keep the results of targets whose worker Pods are gone, such as
+	// workers stopped by the operator.
+	for _, result := range snoopyJob.Status.StepResults {
+		if _, found := latest[result.Target]; !found {
+			results = append(results, finalStepResult(result))
+		}
+	}
+
+	// Updating Status.
+	snoopyJob.Status.StepResults = results
+	return unfinished
+}
+
+// stepResult builds the result of a step from the status of its container
+// in the worker Pod.
+func stepResult(pod *corev1.Pod, step jobv1alpha1.Step) jobv1alpha1.StepResult {
+
+	result := jobv1alpha1.StepResult{
+		Target: pod.Labels[snoopyTargetLabel],
+		Step:   step.Name,
+		Phase:  jobv1alpha1.StepPending,
+	}
+
+	status := containerStatus(pod, step.Name)
+	stopReason := jobv1alpha1.StopReason(pod.Annotations[stopReasonAnnotation])
+
+	if status == nil {
+		if pod.Status.Phase == corev1.PodFailed || stopReason != "" {
+			result.Phase = jobv1alpha1.StepSkipped
+		}
+		return result
+	}
+
+	switch {
+	case status.State.Terminated != nil:
+		terminated := status.State.Terminated
+		exitCode := terminated.ExitCode
+
+		// Steps allowed to fail report their real exit code in the termination message.
+		code, reason, message := parseTerminationMessage(terminated.Message)
+		if step.ContinueOnError && code != nil {
+			exitCode = *code
+		}
+		result.Message = message
+		result.StopReason = reason
+
+		result.ExitCode = &exitCode
+		result.StartTime = terminated.StartedAt.DeepCopy()
+		result.FinishTime = terminated.FinishedAt.DeepCopy()
+		result.Phase = jobv1alpha1.StepSucceeded
+		switch {
+		case stopReason != "" && exitCode != 0:
+			// Killed by the operator on purpose.
+			result.StopReason = stopReason
+		case exitCode != 0:
+			result.Phase = jobv1alpha1.StepFailed
+			if result.Message == "" {
+				result.Message = terminated.Reason
+			}
+		}
+
+	case status.State.Running != nil:
+		result.Phase = jobv1alpha1.StepRunning
+		result.StartTime = status.State.Running.StartedAt.DeepCopy()
+		result.StopReason = stopReason
+
+	case pod.Status.Phase == corev1.PodFailed || stopReason != "":
+		// A previous step failed or the worker was stopped, so this one never started.
+		result.Phase = jobv1alpha1.StepSkipped
+	}
+
+	return result
+}
+
+// containerStatus returns the status of a container or init container of a Pod, if any.
+func containerStatus(pod *corev1.Pod, name string) *corev1.ContainerStatus {
+
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for i := range statuses {
+		if statuses[i].Name == name {
+			return &statuses[i]
+		}
+	}
+
+	return nil
+}
+
+// finalStepResult settles the recorded result of a step whose worker Pod is gone.
+func finalStepResult(result jobv1alpha1.StepResult) jobv1alpha1.StepResult {
+
+	switch {
+	case result.Phase == jobv1alpha1.StepPending:
+		result.Phase = jobv1alpha1.StepSkipped
+	case result.Phase == jobv1alpha1.StepRunning && result.StopReason != "":
+		result.Phase = jobv1alpha1.StepSucceeded
+	case result.Phase == jobv1alpha1.StepRunning:
+		result.Phase = jobv1alpha1.StepFailed
+		result.Message = "worker Pod deleted"
+	}
+
+	return result
+}
@@ -0,0 +1,156 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apimachinery "k8s.io/apimachinery/pkg/types"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// stepArgs returns the arguments of a step command, limiting the packets
+// captured by tcpdump when the SnoopyJob sets MaxPackets.
+func stepArgs(snoopyJob *jobv1alpha1.SnoopyJob, step jobv1alpha1.Step) string {
+
+	stop := snoopyJob.Spec.StopCondition
+	if stop == nil || stop.MaxPackets == nil || step.Command != "tcpdump" {
+		return step.Args
+	}
+
+	return strings.TrimSpace(step.Args + " -c " + strconv.FormatInt(*stop.MaxPackets, 10))
+}
+
+// reconcileTargetConditions stops the running workers whose target Pod has
+// reached the TargetCondition of the SnoopyJob. Their Job is suspended so it
+// is neither retried nor created again, and the worker Pod is annotated with
+// the stop reason for the step results.
+func (r *SnoopyJobReconciler) reconcileTargetConditions(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, workers *corev1.PodList) error {
+
+	stop := snoopyJob.Spec.StopCondition
+	if stop == nil || stop.TargetCondition == nil {
+		return nil
+	}
+
+	for i := range workers.Items {
+		worker := &workers.Items[i]
+
+		// Node targets have no Pod condition to watch.
+		if worker.Spec.HostNetwork || worker.Annotations[stopReasonAnnotation] != "" ||
+			worker.Status.Phase == corev1.PodSucceeded || worker.Status.Phase == corev1.PodFailed {
+			continue
+		}
+
+		targetPod := &corev1.Pod{}
+		err := r.Client.Get(ctx, apimachinery.NamespacedName{Namespace: snoopyJob.Spec.TargetNamespace, Name: worker.Labels[snoopyTargetLabel]}, targetPod)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+
+		if !hasPodCondition(targetPod, stop.TargetCondition) {
+			continue
+		}
+
+		if worker.Annotations == nil {
+			worker.Annotations = map[string]string{}
+		}
+		worker.Annotations[stopReasonAnnotation] = string(jobv1alpha1.StopReasonTargetCondition)
+		if err := r.Client.Update(ctx, worker); err != nil {
+			return err
+		}
+
+		if err := r.suspendWorkerJob(ctx, worker); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasPodCondition tells whether a Pod condition has the status of a TargetCondition.
+func hasPodCondition(pod *corev1.Pod, targetCondition *jobv1alpha1.TargetCondition) bool {
+
+	status := targetCondition.Status
+	if status == "" {
+		status = corev1.ConditionTrue
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == targetCondition.Type {
+			return condition.Status == status
+		}
+	}
+
+	return false
+}
+
+// suspendWorkerJob suspends the Job owning a worker Pod, which terminates its Pods.
+func (r *SnoopyJobReconciler) suspendWorkerJob(ctx context.Context, worker *corev1.Pod) error {
+
+	owner := metav1.GetControllerOf(worker)
+	if owner == nil || owner.Kind != "Job" {
+		return nil
+	}
+
+	job := &batchv1.Job{}
+	if err := r.Client.Get(ctx, apimachinery.NamespacedName{Namespace: worker.Namespace, Name: owner.Name}, job); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if job.Spec.Suspend != nil && *job.Spec.Suspend {
+		return nil
+	}
+
+	suspend := true
+	job.Spec.Suspend = &suspend
+	return r.Client.Update(ctx, job)
+}
+
+// parseTerminationMessage reads the exit code and the stop reason the
+// worker wrapper script writes as key=value lines. Other lines are returned
+// as the message.
+func parseTerminationMessage(terminationMessage string) (exitCode *int32, stopReason jobv1alpha1.StopReason, message string) {
+
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(terminationMessage), "\n") {
+		keyValue := strings.SplitN(line, "=", 2)
+		switch {
+		case len(keyValue) == 2 && keyValue[0] == "exitCode":
+			if code, err := strconv.ParseInt(strings.TrimSpace(keyValue[1]), 10, 32); err == nil {
+				c := int32(code)
+				exitCode = &c
+			}
+		case len(keyValue) == 2 && keyValue[0] == "stopReason":
+			stopReason = jobv1alpha1.StopReason(strings.TrimSpace(keyValue[1]))
+		case line != "":
+			lines = append(lines, line)
+		}
+	}
+
+	return exitCode, stopReason, strings.Join(lines, "\n")
+}
@@ -0,0 +1,211 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"sort"
+	"time"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// The status of a SnoopyJob is built up with an entry per target, read back
+// from the worker Pods at each reconcile. Only counts and up to
+// maxStatusEntries entries of each list are written, so thousands of targets
+// stay below the object size limit. What the reconciler needs back from the
+// status, retries waiting for their next attempt and rejected targets, is
+// always kept. Artifacts left out are counted, and runs older than those kept
+// aren't recorded again. Sampled Pods past the listed ones are still picked
+// again first, as their workers are found.
+
+// countOutcomes counts targets by outcome.
+func countOutcomes(outcomes []jobv1alpha1.TargetOutcome) *jobv1alpha1.TargetCounts {
+
+	counts := &jobv1alpha1.TargetCounts{}
+	for _, outcome := range outcomes {
+		switch outcome.Outcome {
+		case jobv1alpha1.TargetRunning:
+			counts.Running++
+		case jobv1alpha1.TargetRetrying:
+			counts.Retrying++
+		case jobv1alpha1.TargetSucceeded:
+			counts.Succeeded++
+		case jobv1alpha1.TargetFailed:
+			counts.Failed++
+		case jobv1alpha1.TargetStopped:
+			counts.Stopped++
+		}
+	}
+
+	return counts
+}
+
+// compactStatus bounds the per-target lists of a SnoopyJob status before it is written.
+func compactStatus(status *jobv1alpha1.SnoopyJobStatus) {
+
+	if len(status.CronJobList) > maxStatusEntries {
+		status.CronJobList = status.CronJobList[:maxStatusEntries]
+	}
+	if len(status.TemplateErrors) > maxStatusEntries {
+		status.TemplateErrors = status.TemplateErrors[:maxStatusEntries]
+	}
+
+	status.StepResults = compactStepResults(status.StepResults)
+	status.Outcomes = compactOutcomes(status.Outcomes)
+	compacted := compactArtifacts(status.Artifacts)
+	status.PrunedArtifacts += int32(len(status.Artifacts) - len(compacted))
+	status.Artifacts = compacted
+	if len(status.SampledTargets) > maxStatusEntries {
+		status.SampledTargets = status.SampledTargets[:maxStatusEntries]
+	}
+	status.StartSkews = compactStartSkews(status.StartSkews)
+	status.Conflicts = compactConflicts(status.Conflicts)
+}
+
+// compactStepResults keeps the step results of maxStatusEntries targets,
+// those with a failed step first and then those still running.
+func compactStepResults(results []jobv1alpha1.StepResult) []jobv1alpha1.StepResult {
+
+	targets := []string{}
+	byTarget := map[string][]jobv1alpha1.StepResult{}
+	rank := map[string]int{}
+	for _, result := range results {
+		if _, found := byTarget[result.Target]; !found {
+			targets = append(targets, result.Target)
+			rank[result.Target] = 2
+		}
+		byTarget[result.Target] = append(byTarget[result.Target], result)
+
+		switch result.Phase {
+		case jobv1alpha1.StepFailed:
+			rank[result.Target] = 0
+		case jobv1alpha1.StepPending, jobv1alpha1.StepRunning:
+			if rank[result.Target] > 1 {
+				rank[result.Target] = 1
+			}
+		}
+	}
+	if len(targets) <= maxStatusEntries {
+		return results
+	}
+
+	sort.SliceStable(targets, func(i, j int) bool {
+		return rank[targets[i]] < rank[targets[j]]
+	})
+
+	compacted := []jobv1alpha1.StepResult{}
+	for _, target := range targets[:maxStatusEntries] {
+		compacted = append(compacted, byTarget[target]...)
+	}
+	return compacted
+}
+
+// compactOutcomes keeps the outcomes of targets being retried, which hold
+// the attempt they are at, and the latest maxStatusEntries failed or stopped
+// ones. Targets on a first attempt or done with it are only counted.
+func compactOutcomes(outcomes []jobv1alpha1.TargetOutcome) []jobv1alpha1.TargetOutcome {
+
+	ended := 0
+	for _, outcome := range outcomes {
+		if outcome.Outcome == jobv1alpha1.TargetFailed || outcome.Outcome == jobv1alpha1.TargetStopped {
+			ended++
+		}
+	}
+
+	compacted := []jobv1alpha1.TargetOutcome{}
+	for _, outcome := range outcomes {
+		switch {
+		case outcome.Outcome == jobv1alpha1.TargetRetrying:
+		case outcome.Outcome == jobv1alpha1.TargetRunning && outcome.Attempts > 1:
+		case outcome.Outcome == jobv1alpha1.TargetFailed || outcome.Outcome == jobv1alpha1.TargetStopped:
+			ended--
+			if ended >= maxStatusEntries {
+				continue
+			}
+		default:
+			continue
+		}
+		compacted = append(compacted, outcome)
+	}
+
+	return compacted
+}
+
+// compactArtifacts keeps the maxStatusEntries most recent artifacts.
+func compactArtifacts(artifacts []jobv1alpha1.Artifact) []jobv1alpha1.Artifact {
+
+	if len(artifacts) <= maxStatusEntries {
+		return artifacts
+	}
+
+	compacted := append([]jobv1alpha1.Artifact{}, artifacts...)
+	sort.SliceStable(compacted, func(i, j int) bool {
+		return completedBefore(compacted[j], compacted[i])
+	})
+	compacted = compacted[:maxStatusEntries]
+
+	// Back in the order they were recorded.
+	sort.SliceStable(compacted, func(i, j int) bool {
+		return completedBefore(compacted[i], compacted[j])
+	})
+	return compacted
+}
+
+func completedBefore(a jobv1alpha1.Artifact, b jobv1alpha1.Artifact) bool {
+	if a.CompletionTime == nil || b.CompletionTime == nil {
+		return a.CompletionTime == nil && b.CompletionTime != nil
+	}
+	return a.CompletionTime.Before(b.CompletionTime)
+}
+
+// compactStartSkews keeps the maxStatusEntries largest start skews.
+func compactStartSkews(skews []jobv1alpha1.StartSkew) []jobv1alpha1.StartSkew {
+
+	if len(skews) <= maxStatusEntries {
+		return skews
+	}
+
+	compacted := append([]jobv1alpha1.StartSkew{}, skews...)
+	sort.SliceStable(compacted, func(i, j int) bool {
+		return absDuration(compacted[i].Skew.Duration) > absDuration(compacted[j].Skew.Duration)
+	})
+	return compacted[:maxStatusEntries]
+}
+
+// compactConflicts keeps the rejected targets, which stay rejected, and up
+// to maxStatusEntries queued ones.
+func compactConflicts(conflicts []jobv1alpha1.TargetConflict) []jobv1alpha1.TargetConflict {
+
+	queued := 0
+	compacted := []jobv1alpha1.TargetConflict{}
+	for _, conflict := range conflicts {
+		if !conflict.Rejected {
+			if queued >= maxStatusEntries {
+				continue
+			}
+			queued++
+		}
+		compacted = append(compacted, conflict)
+	}
+
+	return compacted
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
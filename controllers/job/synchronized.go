@@ -0,0 +1,251 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// reconcileSynchronizedStart sets a shared start time on the waiting workers
+// of a SnoopyJob once all of them are ready, or once the first ready one has
+// waited for the timeout, and records how far from it each worker started.
+// It returns how soon to check the workers again, zero when nothing waits.
+func (r *SnoopyJobReconciler) reconcileSynchronizedStart(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, workers *corev1.PodList) (time.Duration, error) {
+
+	synchronizedStart := snoopyJob.Spec.SynchronizedStart
+	if synchronizedStart == nil {
+		return 0, nil
+	}
+
+	lead, timeout := defaultStartLead, defaultStartTimeout
+	if synchronizedStart.Lead != nil {
+		lead = synchronizedStart.Lead.Duration
+	}
+	if synchronizedStart.Timeout != nil {
+		timeout = synchronizedStart.Timeout.Duration
+	}
+
+	now := time.Now()
+	firstStep := jobSteps(snoopyJob)[0].Name
+
+	var ready, late []*corev1.Pod
+	waiting := false
+	var readySince time.Time
+	for i := range workers.Items {
+		pod := &workers.Items[i]
+		if pod.Annotations[startAtAnnotation] != "" || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		waiting = true
+
+		status := containerStatus(pod, firstStep)
+		if status == nil || status.State.Running == nil {
+			continue
+		}
+
+		// Retries and workers of a run that already started cannot catch
+		// up with the others, so they start right away.
+		startTime := snoopyJob.Status.StartTime
+		if podAttempt(pod) > 1 || (startTime != nil && pod.CreationTimestamp.Time.Before(startTime.Time)) {
+			late = append(late, pod)
+			continue
+		}
+
+		ready = append(ready, pod)
+		if readySince.IsZero() || status.State.Running.StartedAt.Time.Before(readySince) {
+			readySince = status.State.Running.StartedAt.Time
+		}
+	}
+
+	if err := r.setStartTime(ctx, late, now); err != nil {
+		return 0, err
+	}
+
+	// All the workers listed in the status have to be ready.
+	if len(ready) > 0 && (len(ready) >= int(snoopyJob.Status.Workers) || now.Sub(readySince) >= timeout) {
+		startAt := now.Add(lead)
+		if err := r.setStartTime(ctx, ready, startAt); err != nil {
+			return 0, err
+		}
+
+		// Updating Status.
+		snoopyJob.Status.StartTime = &metav1.MicroTime{Time: startAt}
+		ready = nil
+	}
+
+	skewsPending, err := r.reconcileStartSkews(ctx, snoopyJob, workers, firstStep)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(ready) > 0 {
+		if wait := timeout - now.Sub(readySince); wait < startPollInterval {
+			return wait, nil
+		}
+	}
+	if waiting || skewsPending {
+		return startPollInterval, nil
+	}
+
+	return 0, nil
+}
+
+// setStartTime annotates worker Pods with the time they start at.
+func (r *SnoopyJobReconciler) setStartTime(ctx context.Context, pods []*corev1.Pod, startAt time.Time) error {
+
+	for _, pod := range pods {
+		original := pod.DeepCopy()
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[startAtAnnotation] = startAt.UTC().Format(time.RFC3339Nano)
+		if err := r.Client.Patch(ctx, pod, client.MergeFrom(original)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reconcileStartSkews records when each synchronized worker actually started,
+// as reported in the logs of its first step. It returns true while some
+// worker was given a start time but has not reported yet.
+func (r *SnoopyJobReconciler) reconcileStartSkews(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob, workers *corev1.PodList, firstStep string) (bool, error) {
+
+	recorded := map[string]bool{}
+	for _, skew := range snoopyJob.Status.StartSkews {
+		recorded[skew.Run] = true
+	}
+
+	pending := false
+	skews := append([]jobv1alpha1.StartSkew{}, snoopyJob.Status.StartSkews...)
+	for i := range workers.Items {
+		pod := &workers.Items[i]
+		if recorded[pod.Name] || pod.Annotations[startAtAnnotation] == "" {
+			continue
+		}
+
+		startAt, err := time.Parse(time.RFC3339Nano, pod.Annotations[startAtAnnotation])
+		if err != nil {
+			continue
+		}
+
+		startedAt, err := r.workerStartedAt(ctx, pod, firstStep)
+		if err != nil {
+			return false, err
+		}
+		if startedAt == nil {
+			pending = pending || time.Now().Before(startAt.Add(time.Minute))
+			continue
+		}
+
+		skews = setStartSkew(skews, jobv1alpha1.StartSkew{
+			Target:    pod.Labels[snoopyTargetLabel],
+			Run:       pod.Name,
+			StartedAt: metav1.MicroTime{Time: *startedAt},
+			Skew:      metav1.Duration{Duration: startedAt.Sub(startAt)},
+		})
+	}
+
+	// Updating Status.
+	snoopyJob.Status.StartSkews = skews
+	return pending, nil
+}
+
+// workerStartedAt reads the start reported by a synchronized worker, nil
+// when it has not started yet. The start is kept on the worker Pod once
+// read, so its logs are only read until then.
+func (r *SnoopyJobReconciler) workerStartedAt(ctx context.Context, pod *corev1.Pod, firstStep string) (*time.Time, error) {
+
+	if startedAt, err := time.Parse(time.RFC3339Nano, pod.Annotations[startedAtAnnotation]); err == nil {
+		return &startedAt, nil
+	}
+
+	status := containerStatus(pod, firstStep)
+	if status == nil || (status.State.Running == nil && status.State.Terminated == nil) {
+		return nil, nil
+	}
+
+	// The start is reported before podtracer writes anything.
+	limitBytes := int64(4096)
+	logs, err := r.Clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container:  firstStep,
+		LimitBytes: &limitBytes,
+	}).DoRaw(ctx)
+	if err != nil {
+		if errors.IsBadRequest(err) || errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(logs))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, startedAtPrefix) {
+			continue
+		}
+		startedAt, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(line, startedAtPrefix))
+		if err != nil {
+			return nil, nil
+		}
+
+		original := pod.DeepCopy()
+		pod.Annotations[startedAtAnnotation] = startedAt.UTC().Format(time.RFC3339Nano)
+		if err := r.Client.Patch(ctx, pod, client.MergeFrom(original)); err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		return &startedAt, nil
+	}
+
+	return nil, nil
+}
+
+// setStartSkew replaces the start skew of a target with the one of its latest run.
+func setStartSkew(skews []jobv1alpha1.StartSkew, skew jobv1alpha1.StartSkew) []jobv1alpha1.StartSkew {
+
+	for i := range skews {
+		if skews[i].Target == skew.Target {
+			skews[i] = skew
+			return skews
+		}
+	}
+
+	return append(skews, skew)
+}
+
+// stripStartedAt removes the start reported by a synchronized worker from its output.
+func stripStartedAt(logs []byte) []byte {
+
+	if !bytes.HasPrefix(logs, []byte(startedAtPrefix)) {
+		return logs
+	}
+	if i := bytes.IndexByte(logs, '\n'); i >= 0 {
+		return logs[i+1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,357 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	apimachinery "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// target is a Pod or a Node a SnoopyJob runs podtracer against.
+type target struct {
+	// name identifies the target in worker names, labels and status.
+	name string
+	// namespace is the namespace of a target Pod, empty for a Node.
+	namespace string
+	// nodeName is the Node the worker Pod has to run on.
+	nodeName string
+	// host is set for Node targets, run in the host network namespace.
+	host bool
+	// pod or node is the target object, for argument templates.
+	pod  *corev1.Pod
+	node *corev1.Node
+	// dataAddress is the data endpoint replica the target streams to,
+	// empty to stream through the data service.
+	dataAddress string
+}
+
+func podTarget(pod *corev1.Pod) target {
+	return target{
+		name:      pod.ObjectMeta.Name,
+		namespace: pod.ObjectMeta.Namespace,
+		nodeName:  pod.Spec.NodeName,
+		pod:       pod,
+	}
+}
+
+func nodeTarget(node *corev1.Node) target {
+	return target{
+		name:     "node-" + node.ObjectMeta.Name,
+		nodeName: node.ObjectMeta.Name,
+		host:     true,
+		node:     node,
+	}
+}
+
+// podtracerTargetOptions returns the podtracer arguments selecting the target.
+func (t target) podtracerTargetOptions() []string {
+	if t.host {
+		return []string{"--host"}
+	}
+	return []string{"--pod", t.name, "-n", t.namespace}
+}
+
+// outputDir is the directory holding the runs of the target on the
+// PersistentVolumeClaim output sink.
+func (t target) outputDir() string {
+	if t.host {
+		return path.Join("nodes", t.nodeName)
+	}
+	return path.Join(t.namespace, t.name)
+}
+
+// getTargets returns the Pods and Nodes selected by a SnoopyJob.
+func (r *SnoopyJobReconciler) getTargets(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob) ([]target, error) {
+
+	targets := []target{}
+
+	// Pods are selected unless the SnoopyJob only targets Nodes.
+	if snoopyJob.Spec.TargetRef != nil {
+		pods, err := r.getPodsByTargetRef(ctx, snoopyJob.Spec.TargetRef, snoopyJob.Spec.TargetNamespace)
+		if err != nil {
+			return nil, err
+		}
+		for i := range pods {
+			targets = append(targets, podTarget(&pods[i]))
+		}
+	} else if snoopyJob.Spec.TargetNodes == nil || len(snoopyJob.Spec.LabelSelector) > 0 {
+		podlist, err := r.getRunningPodsByLabel(ctx, snoopyJob.Spec.LabelSelector, snoopyJob.Spec.TargetNamespace)
+		if err != nil {
+			return nil, err
+		}
+		for i := range podlist.Items {
+			targets = append(targets, podTarget(&podlist.Items[i]))
+		}
+	}
+
+	if snoopyJob.Spec.TargetNodes != nil {
+		nodes, err := r.getNodes(ctx, snoopyJob.Spec.TargetNodes)
+		if err != nil {
+			return nil, err
+		}
+		for i := range nodes {
+			targets = append(targets, nodeTarget(&nodes[i]))
+		}
+	}
+
+	if snoopyJob.Spec.Sampling != nil {
+		previous, err := r.previouslySampled(ctx, snoopyJob)
+		if err != nil {
+			return nil, err
+		}
+		targets = sampleTargets(snoopyJob, targets, previous)
+
+		// Updating Status.
+		snoopyJob.Status.SampledTargets = sampledTargetNames(targets)
+		snoopyJob.Status.SampledCount = int32(len(snoopyJob.Status.SampledTargets))
+	}
+
+	return targets, nil
+}
+
+// getNodes returns the Nodes listed by name or matching the labels of a TargetNodes selector.
+func (r *SnoopyJobReconciler) getNodes(ctx context.Context, targetNodes *jobv1alpha1.TargetNodes) ([]corev1.Node, error) {
+
+	nodes := []corev1.Node{}
+	selected := map[string]bool{}
+
+	for _, name := range targetNodes.Names {
+		node := &corev1.Node{}
+		if err := r.Client.Get(ctx, apimachinery.NamespacedName{Name: name}, node); err != nil {
+			if errors.IsNotFound(err) {
+				return nil, fmt.Errorf("target node %s not found", name)
+			}
+			return nil, err
+		}
+		selected[node.Name] = true
+		nodes = append(nodes, *node)
+	}
+
+	if len(targetNodes.LabelSelector) > 0 {
+		nodelist := &corev1.NodeList{}
+		if err := r.Client.List(ctx, nodelist, client.MatchingLabels(targetNodes.LabelSelector)); err != nil {
+			return nil, err
+		}
+		for _, node := range nodelist.Items {
+			if !selected[node.Name] {
+				selected[node.Name] = true
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no node corresponds to names %v and labels %v", targetNodes.Names, targetNodes.LabelSelector)
+	}
+
+	return nodes, nil
+}
+
+// getPodsByTargetRef resolves a TargetRef to the Pods it points to.
+func (r *SnoopyJobReconciler) getPodsByTargetRef(ctx context.Context, targetRef *jobv1alpha1.TargetRef, namespace string) ([]corev1.Pod, error) {
+
+	var pods []corev1.Pod
+	var err error
+
+	switch targetRef.Kind {
+	case "Service":
+		pods, err = r.getPodsByService(ctx, targetRef.Name, namespace)
+	case "Deployment":
+		pods, err = r.getPodsByDeployment(ctx, targetRef.Name, namespace)
+	case "StatefulSet":
+		pods, err = r.getPodsByOwner(ctx, &appsv1.StatefulSet{}, targetRef.Name, namespace)
+	case "DaemonSet":
+		pods, err = r.getPodsByOwner(ctx, &appsv1.DaemonSet{}, targetRef.Name, namespace)
+	default:
+		return nil, fmt.Errorf("unsupported target kind %s", targetRef.Kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("no running pod backs %s %s in namespace %v", targetRef.Kind, targetRef.Name, namespace)
+	}
+
+	return pods, nil
+}
+
+// getPodsByService returns the running Pods behind the ready endpoints of a Service.
+func (r *SnoopyJobReconciler) getPodsByService(ctx context.Context, name string, namespace string) ([]corev1.Pod, error) {
+
+	slices := &discoveryv1.EndpointSliceList{}
+	listOpts := []client.ListOption{
+		client.MatchingLabels{discoveryv1.LabelServiceName: name},
+		client.InNamespace(namespace),
+	}
+	if err := r.Client.List(ctx, slices, listOpts...); err != nil {
+		return nil, err
+	}
+
+	pods := []corev1.Pod{}
+	selected := map[string]bool{}
+	for _, slice := range slices.Items {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" || selected[endpoint.TargetRef.Name] {
+				continue
+			}
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+
+			pod := &corev1.Pod{}
+			err := r.Client.Get(ctx, apimachinery.NamespacedName{Namespace: namespace, Name: endpoint.TargetRef.Name}, pod)
+			if err != nil {
+				if errors.IsNotFound(err) {
+					continue
+				}
+				return nil, err
+			}
+			if !runningOnNode(pod) {
+				continue
+			}
+			selected[pod.Name] = true
+			pods = append(pods, *pod)
+		}
+	}
+
+	return pods, nil
+}
+
+// getPodsByDeployment returns the running Pods owned by the ReplicaSets of a Deployment.
+func (r *SnoopyJobReconciler) getPodsByDeployment(ctx context.Context, name string, namespace string) ([]corev1.Pod, error) {
+
+	deployment := &appsv1.Deployment{}
+	if err := r.Client.Get(ctx, apimachinery.NamespacedName{Namespace: namespace, Name: name}, deployment); err != nil {
+		return nil, err
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	replicaSets := &appsv1.ReplicaSetList{}
+	listOpts := []client.ListOption{
+		client.MatchingLabelsSelector{Selector: selector},
+		client.InNamespace(namespace),
+	}
+	if err := r.Client.List(ctx, replicaSets, listOpts...); err != nil {
+		return nil, err
+	}
+
+	owners := map[apimachinery.UID]bool{}
+	for i := range replicaSets.Items {
+		if metav1.IsControlledBy(&replicaSets.Items[i], deployment) {
+			owners[replicaSets.Items[i].UID] = true
+		}
+	}
+
+	return r.getPodsControlledBy(ctx, selector, namespace, owners)
+}
+
+// getPodsByOwner returns the running Pods owned by a StatefulSet or a DaemonSet.
+func (r *SnoopyJobReconciler) getPodsByOwner(ctx context.Context, owner client.Object, name string, namespace string) ([]corev1.Pod, error) {
+
+	if err := r.Client.Get(ctx, apimachinery.NamespacedName{Namespace: namespace, Name: name}, owner); err != nil {
+		return nil, err
+	}
+
+	var labelSelector *metav1.LabelSelector
+	switch workload := owner.(type) {
+	case *appsv1.StatefulSet:
+		labelSelector = workload.Spec.Selector
+	case *appsv1.DaemonSet:
+		labelSelector = workload.Spec.Selector
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.getPodsControlledBy(ctx, selector, namespace, map[apimachinery.UID]bool{owner.GetUID(): true})
+}
+
+// getPodsControlledBy returns the running Pods matching a selector whose
+// controller is one of the given owners.
+func (r *SnoopyJobReconciler) getPodsControlledBy(ctx context.Context, selector labels.Selector, namespace string, owners map[apimachinery.UID]bool) ([]corev1.Pod, error) {
+
+	podlist := &corev1.PodList{}
+	listOpts := []client.ListOption{
+		client.MatchingLabelsSelector{Selector: selector},
+		client.MatchingFields{podPhaseField: string(corev1.PodRunning)},
+		client.InNamespace(namespace),
+	}
+	if err := r.Client.List(ctx, podlist, listOpts...); err != nil {
+		return nil, err
+	}
+
+	pods := []corev1.Pod{}
+	for _, pod := range podlist.Items {
+		if !runningOnNode(&pod) {
+			continue
+		}
+		if controller := metav1.GetControllerOf(&pod); controller != nil && owners[controller.UID] {
+			pods = append(pods, pod)
+		}
+	}
+
+	return pods, nil
+}
+
+// runningOnNode tells whether a Pod runs on a Node workers can be scheduled on
+// next to it. Pending Pods have no Node yet and finished ones nothing to trace.
+func runningOnNode(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodRunning && pod.Spec.NodeName != ""
+}
+
+// snoopyJobsForEndpointSlice maps an EndpointSlice to the SnoopyJobs
+// targeting its Service, so targets follow the endpoints.
+func (r *SnoopyJobReconciler) snoopyJobsForEndpointSlice(object client.Object) []reconcile.Request {
+
+	serviceName := object.GetLabels()[discoveryv1.LabelServiceName]
+	if serviceName == "" {
+		return nil
+	}
+
+	snoopyJobs := &jobv1alpha1.SnoopyJobList{}
+	if err := r.Client.List(context.TODO(), snoopyJobs); err != nil {
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, snoopyJob := range snoopyJobs.Items {
+		targetRef := snoopyJob.Spec.TargetRef
+		if targetRef != nil && targetRef.Kind == "Service" && targetRef.Name == serviceName && snoopyJob.Spec.TargetNamespace == object.GetNamespace() {
+			requests = append(requests, reconcile.Request{NamespacedName: apimachinery.NamespacedName{Namespace: snoopyJob.Namespace, Name: snoopyJob.Name}})
+		}
+	}
+
+	return requests
+}
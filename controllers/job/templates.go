@@ -0,0 +1,177 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// templateObject is a Pod or a Node as seen by argument templates.
+type templateObject struct {
+	Name        string
+	Namespace   string
+	IP          string
+	Node        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// templateData is what argument templates are rendered with. Pod is set for
+// Pod targets and Node for Node targets. Peer is the peer Pod picked for the
+// target among Peers.
+type templateData struct {
+	Pod   *templateObject
+	Node  *templateObject
+	Peer  *templateObject
+	Peers []templateObject
+}
+
+func podTemplateObject(pod *corev1.Pod) templateObject {
+	return templateObject{
+		Name:        pod.Name,
+		Namespace:   pod.Namespace,
+		IP:          pod.Status.PodIP,
+		Node:        pod.Spec.NodeName,
+		Labels:      pod.Labels,
+		Annotations: pod.Annotations,
+	}
+}
+
+func nodeTemplateObject(node *corev1.Node) templateObject {
+
+	object := templateObject{
+		Name:        node.Name,
+		Node:        node.Name,
+		Labels:      node.Labels,
+		Annotations: node.Annotations,
+	}
+	for _, address := range node.Status.Addresses {
+		if address.Type == corev1.NodeInternalIP {
+			object.IP = address.Address
+			break
+		}
+	}
+
+	return object
+}
+
+// getPeers returns the running peer Pods of a SnoopyJob, sorted by name.
+func (r *SnoopyJobReconciler) getPeers(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob) ([]corev1.Pod, error) {
+
+	peers := snoopyJob.Spec.Peers
+	if peers == nil {
+		return nil, nil
+	}
+
+	namespace := peers.Namespace
+	if namespace == "" {
+		namespace = snoopyJob.Spec.TargetNamespace
+	}
+
+	podlist := &corev1.PodList{}
+	listOpts := []client.ListOption{
+		client.MatchingLabels(peers.LabelSelector),
+		client.InNamespace(namespace),
+	}
+	if err := r.Client.List(ctx, podlist, listOpts...); err != nil {
+		return nil, err
+	}
+
+	pods := []corev1.Pod{}
+	for _, pod := range podlist.Items {
+		if pod.Status.Phase == corev1.PodRunning && pod.Status.PodIP != "" {
+			pods = append(pods, pod)
+		}
+	}
+
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].Name < pods[j].Name
+	})
+
+	return pods, nil
+}
+
+// newTemplateData builds the template data of a target. The peer of a target
+// is picked by a hash of its name so it stays the same across reconciles,
+// and is never the target itself.
+func newTemplateData(target target, peers []corev1.Pod) templateData {
+
+	data := templateData{Peers: []templateObject{}}
+
+	if target.pod != nil {
+		object := podTemplateObject(target.pod)
+		data.Pod = &object
+	}
+	if target.node != nil {
+		object := nodeTemplateObject(target.node)
+		data.Node = &object
+	}
+
+	candidates := []templateObject{}
+	for i := range peers {
+		object := podTemplateObject(&peers[i])
+		data.Peers = append(data.Peers, object)
+		if target.pod == nil || peers[i].UID != target.pod.UID {
+			candidates = append(candidates, object)
+		}
+	}
+
+	if len(candidates) > 0 {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(target.name))
+		data.Peer = &candidates[hash.Sum32()%uint32(len(candidates))]
+	}
+
+	return data
+}
+
+// renderArgs renders the arguments of a step. Missing fields, like .Peer
+// when there is no peer, are errors rather than empty strings.
+func renderArgs(args string, data templateData) (string, error) {
+
+	if !strings.Contains(args, "{{") {
+		return args, nil
+	}
+
+	tmpl, err := template.New("args").Option("missingkey=error").Parse(args)
+	if err != nil {
+		return "", err
+	}
+
+	rendered := &strings.Builder{}
+	if err := tmpl.Execute(rendered, data); err != nil {
+		return "", err
+	}
+
+	return rendered.String(), nil
+}
+
+// updateTemplateErrors records the argument template errors in the SnoopyJob status.
+func updateTemplateErrors(snoopyJob *jobv1alpha1.SnoopyJob, templateErrors []jobv1alpha1.TemplateError) {
+
+	if len(templateErrors) == 0 {
+		templateErrors = nil
+	}
+	snoopyJob.Status.TemplateErrors = templateErrors
+}
@@ -0,0 +1,104 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package job
+
+import (
+	"context"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	jobv1alpha1 "github.com/fennec-project/snoopy-operator/apis/job/v1alpha1"
+)
+
+// activationWindow returns the phase of a SnoopyJob at a given time and how
+// long until its next window boundary, zero when there is none.
+func activationWindow(snoopyJob *jobv1alpha1.SnoopyJob, now time.Time) (jobv1alpha1.SnoopyJobPhase, time.Duration) {
+
+	if snoopyJob.Spec.MaxRuns != nil && snoopyJob.Status.ScheduledRuns >= *snoopyJob.Spec.MaxRuns {
+		return jobv1alpha1.SnoopyJobExpired, 0
+	}
+
+	if activeFrom := snoopyJob.Spec.ActiveFrom; activeFrom != nil && now.Before(activeFrom.Time) {
+		return jobv1alpha1.SnoopyJobPending, activeFrom.Sub(now)
+	}
+
+	if activeUntil := snoopyJob.Spec.ActiveUntil; activeUntil != nil {
+		if !now.Before(activeUntil.Time) {
+			return jobv1alpha1.SnoopyJobExpired, 0
+		}
+		return jobv1alpha1.SnoopyJobActive, activeUntil.Sub(now)
+	}
+
+	return jobv1alpha1.SnoopyJobActive, 0
+}
+
+// listCronJobs lists the CronJobs of a SnoopyJob.
+func (r *SnoopyJobReconciler) listCronJobs(ctx context.Context, snoopyJob *jobv1alpha1.SnoopyJob) (*batchv1.CronJobList, error) {
+
+	cronJobs := &batchv1.CronJobList{}
+	listOpts := []client.ListOption{
+		client.MatchingLabels(snoopyJobLabels(snoopyJob)),
+		client.MatchingFields{snoopyJobField: snoopyJobKey(snoopyJob.Namespace, snoopyJob.Name)},
+		client.InNamespace("snoopy-operator"),
+	}
+	if err := r.Client.List(ctx, cronJobs, listOpts...); err != nil {
+		return nil, err
+	}
+
+	return cronJobs, nil
+}
+
+// countScheduledRuns counts a new run each time the CronJobs of a SnoopyJob
+// have been scheduled since the last count.
+func countScheduledRuns(snoopyJob *jobv1alpha1.SnoopyJob, cronJobs *batchv1.CronJobList) {
+
+	// All CronJobs share the same schedule, so the latest one tells about the run.
+	scheduled := false
+	for _, cronJob := range cronJobs.Items {
+		lastScheduleTime := cronJob.Status.LastScheduleTime
+		if lastScheduleTime != nil && (snoopyJob.Status.LastScheduleTime == nil || snoopyJob.Status.LastScheduleTime.Before(lastScheduleTime)) {
+			snoopyJob.Status.LastScheduleTime = lastScheduleTime.DeepCopy()
+			scheduled = true
+		}
+	}
+
+	// Updating Status.
+	if scheduled {
+		snoopyJob.Status.ScheduledRuns++
+	}
+}
+
+// suspendCronJobs suspends or resumes the CronJobs of a SnoopyJob.
+func (r *SnoopyJobReconciler) suspendCronJobs(ctx context.Context, cronJobs *batchv1.CronJobList, suspend bool) error {
+
+	for i := range cronJobs.Items {
+		cronJob := &cronJobs.Items[i]
+		if cronJob.Spec.Suspend != nil && *cronJob.Spec.Suspend == suspend {
+			continue
+		}
+		if cronJob.Spec.Suspend == nil && !suspend {
+			continue
+		}
+
+		cronJob.Spec.Suspend = &suspend
+		if err := r.Client.Update(ctx, cronJob); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -19,6 +19,8 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type DataEndpointClient interface {
 	ExportPodData(ctx context.Context, opts ...grpc.CallOption) (DataEndpoint_ExportPodDataClient, error)
+	FinalizeStreams(ctx context.Context, in *FinalizeRequest, opts ...grpc.CallOption) (*FinalizeResponse, error)
+	GetStats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error)
 }
 
 type dataEndpointClient struct {
@@ -60,11 +62,31 @@ func (x *dataEndpointExportPodDataClient) Recv() (*Response, error) {
 	return m, nil
 }
 
+func (c *dataEndpointClient) FinalizeStreams(ctx context.Context, in *FinalizeRequest, opts ...grpc.CallOption) (*FinalizeResponse, error) {
+	out := new(FinalizeResponse)
+	err := c.cc.Invoke(ctx, "/protobuf.DataEndpoint/FinalizeStreams", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dataEndpointClient) GetStats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error) {
+	out := new(StatsResponse)
+	err := c.cc.Invoke(ctx, "/protobuf.DataEndpoint/GetStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // DataEndpointServer is the server API for DataEndpoint service.
 // All implementations must embed UnimplementedDataEndpointServer
 // for forward compatibility
 type DataEndpointServer interface {
 	ExportPodData(DataEndpoint_ExportPodDataServer) error
+	FinalizeStreams(context.Context, *FinalizeRequest) (*FinalizeResponse, error)
+	GetStats(context.Context, *StatsRequest) (*StatsResponse, error)
 	mustEmbedUnimplementedDataEndpointServer()
 }
 
@@ -75,6 +97,12 @@ type UnimplementedDataEndpointServer struct {
 func (UnimplementedDataEndpointServer) ExportPodData(DataEndpoint_ExportPodDataServer) error {
 	return status.Errorf(codes.Unimplemented, "method ExportPodData not implemented")
 }
+func (UnimplementedDataEndpointServer) FinalizeStreams(context.Context, *FinalizeRequest) (*FinalizeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FinalizeStreams not implemented")
+}
+func (UnimplementedDataEndpointServer) GetStats(context.Context, *StatsRequest) (*StatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
 func (UnimplementedDataEndpointServer) mustEmbedUnimplementedDataEndpointServer() {}
 
 // UnsafeDataEndpointServer may be embedded to opt out of forward compatibility for this service.
@@ -114,13 +142,58 @@ func (x *dataEndpointExportPodDataServer) Recv() (*PodData, error) {
 	return m, nil
 }
 
+func _DataEndpoint_FinalizeStreams_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FinalizeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataEndpointServer).FinalizeStreams(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protobuf.DataEndpoint/FinalizeStreams",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataEndpointServer).FinalizeStreams(ctx, req.(*FinalizeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DataEndpoint_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataEndpointServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protobuf.DataEndpoint/GetStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataEndpointServer).GetStats(ctx, req.(*StatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // DataEndpoint_ServiceDesc is the grpc.ServiceDesc for DataEndpoint service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
 var DataEndpoint_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "protobuf.DataEndpoint",
 	HandlerType: (*DataEndpointServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "FinalizeStreams",
+			Handler:    _DataEndpoint_FinalizeStreams_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _DataEndpoint_GetStats_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "ExportPodData",
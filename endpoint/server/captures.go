@@ -0,0 +1,245 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// An ExportPodData stream is named by the Name of its first PodData, <pod>
+// or <pod>-<tag> for the steps of a SnoopyJob, which is also the file its data
+// is stored in. Names holding a path are refused. Clients describe the
+// stream with gRPC metadata, all of it optional:
+//
+//	snoopy-namespace     namespace of the target Pod, refused when it holds a path
+//	snoopy-pod           name of the target Pod, the stream name by default
+//	snoopy-job           SnoopyJob the stream belongs to
+//	snoopy-max-bytes     bytes after which the stream is stopped, see stop.go
+//	snoopy-stop-pattern  regular expression stopping the stream once its data matches
+//
+// podtracer sends the first three with `run --job` and the stop conditions
+// with `run --max-bytes` and `--stop-pattern`, which the operator only passes
+// to images it is told support them. A stream without metadata is kept under
+// its name alone: it matches no namespace or job filter of the HTTP API and
+// is left out of the bundles of SnoopyJobs. Raw connections give the same
+// description in their preamble, see parsePreamble.
+
+// Stream metadata keys podtracer sets to describe what it captures.
+const (
+	namespaceKey = "snoopy-namespace"
+	podKey       = "snoopy-pod"
+	jobKey       = "snoopy-job"
+)
+
+// metaSuffix marks the file describing a capture file.
+const metaSuffix = ".meta"
+
+// captureMeta describes the stream a capture file holds the data of. It is
+// kept next to the file, in <file>.meta.
+type captureMeta struct {
+	// Stream is the name the stream sent its data under, <pod>[-<tag>].
+	Stream    string    `json:"stream"`
+	Namespace string    `json:"namespace,omitempty"`
+	Pod       string    `json:"pod"`
+	Job       string    `json:"job,omitempty"`
+	Start     time.Time `json:"start"`
+}
+
+// streamMeta reads the description of a gRPC stream from its metadata.
+func streamMeta(ctx context.Context, name string) (captureMeta, error) {
+
+	meta := captureMeta{Stream: name, Pod: name, Start: time.Now().UTC()}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return meta, nil
+	}
+	if values := md.Get(namespaceKey); len(values) > 0 {
+		meta.Namespace = values[0]
+	}
+	if values := md.Get(podKey); len(values) > 0 && values[0] != "" {
+		meta.Pod = values[0]
+	}
+	if values := md.Get(jobKey); len(values) > 0 {
+		meta.Job = values[0]
+	}
+
+	// The namespace becomes a directory in the bundles of SnoopyJobs.
+	if meta.Namespace != "" && !validName(meta.Namespace) {
+		return captureMeta{}, fmt.Errorf("invalid namespace %q", meta.Namespace)
+	}
+
+	return meta, nil
+}
+
+// validName tells whether a stream name can stand for a file of the capture
+// directory, holding no path.
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/\\") && name != "." && name != ".."
+}
+
+func writeMeta(file string, meta captureMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file+metaSuffix, data, 0644)
+}
+
+// captureInfo is a capture file as listed by the HTTP API.
+type captureInfo struct {
+	captureMeta
+
+	// File names the capture in the HTTP API.
+	File    string    `json:"file"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// Live is set while a stream is being written to the file.
+	Live bool `json:"live"`
+	// Truncated is why the capture was cut short, if it was.
+	Truncated string `json:"truncated,omitempty"`
+
+	path string
+}
+
+// captureFilter selects captures. Empty fields match all of them.
+type captureFilter struct {
+	namespace string
+	pod       string
+	job       string
+	from      time.Time
+	to        time.Time
+}
+
+func (f captureFilter) matches(info *captureInfo) bool {
+	switch {
+	case f.namespace != "" && info.Namespace != f.namespace:
+		return false
+	case f.pod != "" && info.Pod != f.pod:
+		return false
+	case f.job != "" && info.Job != f.job:
+		return false
+	case !f.from.IsZero() && info.ModTime.Before(f.from):
+		return false
+	case !f.to.IsZero() && info.Start.After(f.to):
+		return false
+	}
+	return true
+}
+
+// listCaptures returns the captures of the given directories matching a
+// filter, oldest first. The first directory wins when names collide.
+func (s server) listCaptures(dirs []string, filter captureFilter) ([]*captureInfo, error) {
+
+	captures := []*captureInfo{}
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if seen[name] || strings.HasSuffix(name, metaSuffix) || strings.HasSuffix(name, truncatedSuffix) {
+				continue
+			}
+			info, err := s.captureInfo(dir, name)
+			if err != nil || info == nil {
+				continue
+			}
+			seen[name] = true
+			if filter.matches(info) {
+				captures = append(captures, info)
+			}
+		}
+	}
+
+	sort.Slice(captures, func(i, j int) bool {
+		return captures[i].Start.Before(captures[j].Start)
+	})
+
+	return captures, nil
+}
+
+// findCapture returns the capture file of the given name, nil if there is none.
+func (s server) findCapture(dirs []string, name string) (*captureInfo, error) {
+
+	if !validName(name) || strings.HasSuffix(name, metaSuffix) || strings.HasSuffix(name, truncatedSuffix) {
+		return nil, nil
+	}
+
+	for _, dir := range dirs {
+		info, err := s.captureInfo(dir, name)
+		if err != nil || info != nil {
+			return info, err
+		}
+	}
+
+	return nil, nil
+}
+
+// captureInfo describes the capture file name of dir, nil if it is not one.
+func (s server) captureInfo(dir string, name string) (*captureInfo, error) {
+
+	path := filepath.Join(dir, name)
+	stat, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	info := &captureInfo{
+		File:    name,
+		Size:    stat.Size(),
+		ModTime: stat.ModTime().UTC(),
+		path:    path,
+	}
+
+	// Files written before metadata was kept only have their name.
+	if data, err := os.ReadFile(path + metaSuffix); err == nil {
+		_ = json.Unmarshal(data, &info.captureMeta)
+	}
+	if info.Stream == "" {
+		stream, _, rotated := parseRotated(name)
+		if !rotated {
+			stream = name
+		}
+		info.Stream, info.Pod, info.Start = stream, stream, info.ModTime
+	}
+
+	if reason, err := os.ReadFile(path + truncatedSuffix); err == nil {
+		info.Truncated = strings.TrimSpace(string(reason))
+	}
+	info.Live = s.streams.writing(path)
+
+	return info, nil
+}
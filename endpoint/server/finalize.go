@@ -0,0 +1,128 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+
+	pb "github.com/fennec-project/snoopy-operator/endpoint/proto"
+)
+
+// stream is an open ExportPodData stream, known by the pod name it carries.
+type stream struct {
+	name string
+	// capture writes the data of the stream.
+	capture *capture
+	// finalize receives the reason to end the stream early.
+	finalize chan string
+}
+
+// streams tracks the open streams so the operator can finalize them.
+type streams struct {
+	sync.Mutex
+	open map[*stream]bool
+}
+
+func newStreams() *streams {
+	return &streams{open: map[*stream]bool{}}
+}
+
+func (s *streams) add(st *stream) {
+	s.Lock()
+	defer s.Unlock()
+	s.open[st] = true
+}
+
+func (s *streams) remove(st *stream) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.open, st)
+}
+
+// writing tells whether a stream is being written to file.
+func (s *streams) writing(file string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for st := range s.open {
+		if st.capture != nil && st.capture.file() == file {
+			return true
+		}
+	}
+	return false
+}
+
+// finalize asks the open streams of the given names, namespace and job to
+// end and returns their names.
+func (s *streams) finalize(names []string, namespace string, job string, reason string) []string {
+	s.Lock()
+	defer s.Unlock()
+
+	finalized := []string{}
+	for st := range s.open {
+		if !st.matches(names, namespace, job) {
+			continue
+		}
+		select {
+		case st.finalize <- reason:
+		default:
+		}
+		finalized = append(finalized, st.name)
+	}
+
+	return finalized
+}
+
+// matches tells whether a stream has one of the given names and, as far as
+// its metadata tells, the given namespace and job. Empty ones match all
+// streams. Streams without metadata are only known by their name.
+func (st *stream) matches(names []string, namespace string, job string) bool {
+
+	if st.capture == nil || !containsString(names, st.name) {
+		return false
+	}
+
+	meta := st.capture.meta
+	switch {
+	case namespace != "" && meta.Namespace != "" && meta.Namespace != namespace:
+		return false
+	case job != "" && meta.Job != "" && meta.Job != job:
+		return false
+	}
+	return true
+}
+
+// markTruncated records next to the data file of a stream why it was cut short.
+func markTruncated(file string, reason string) {
+	if err := os.WriteFile(file+".truncated", []byte(reason+"\n"), 0644); err != nil {
+		log.Printf("error marking %v truncated: %v", file, err)
+	}
+}
+
+func (s server) FinalizeStreams(ctx context.Context, req *pb.FinalizeRequest) (*pb.FinalizeResponse, error) {
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "Finalized"
+	}
+
+	finalized := s.streams.finalize(req.Names, req.Namespace, req.Job, reason)
+	log.Printf("finalize streams %v: %v", finalized, reason)
+
+	return &pb.FinalizeResponse{Finalized: finalized}, nil
+}
@@ -0,0 +1,96 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestStreamMatches(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		stream    string
+		meta      captureMeta
+		names     []string
+		namespace string
+		job       string
+		matches   bool
+	}{
+		{
+			name:    "exact name",
+			stream:  "web",
+			names:   []string{"web"},
+			matches: true,
+		},
+		{
+			name:   "name prefix",
+			stream: "web-7d9f-abc",
+			names:  []string{"web"},
+		},
+		{
+			name:    "tagged stream",
+			stream:  "web-dump",
+			names:   []string{"web-dump", "web-trace"},
+			matches: true,
+		},
+		{
+			name:      "same namespace and job",
+			stream:    "web",
+			meta:      captureMeta{Namespace: "shop", Job: "capture"},
+			names:     []string{"web"},
+			namespace: "shop",
+			job:       "capture",
+			matches:   true,
+		},
+		{
+			name:      "other namespace",
+			stream:    "web",
+			meta:      captureMeta{Namespace: "blog", Job: "capture"},
+			names:     []string{"web"},
+			namespace: "shop",
+			job:       "capture",
+		},
+		{
+			name:      "other job",
+			stream:    "web",
+			meta:      captureMeta{Namespace: "shop", Job: "debug"},
+			names:     []string{"web"},
+			namespace: "shop",
+			job:       "capture",
+		},
+		{
+			name:      "stream without metadata",
+			stream:    "web",
+			names:     []string{"web"},
+			namespace: "shop",
+			job:       "capture",
+			matches:   true,
+		},
+		{
+			name:   "no names",
+			stream: "web",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			st := &stream{name: test.stream, capture: &capture{name: test.stream, meta: test.meta}}
+			if matches := st.matches(test.names, test.namespace, test.job); matches != test.matches {
+				t.Errorf("matches(%v, %q, %q) = %v, want %v", test.names, test.namespace, test.job, matches, test.matches)
+			}
+		})
+	}
+}
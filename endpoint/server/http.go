@@ -0,0 +1,290 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The HTTP API browses and downloads the captures:
+//
+//	GET /api/v1/captures?namespace=&pod=&job=&from=&to=  lists captures
+//	GET /api/v1/captures/<file>                          describes a capture
+//	GET /api/v1/captures/<file>/data                     downloads it, Range requests included
+//	GET /api/v1/jobs/<job>/bundle?format=tar|zip         bundles the captures of a SnoopyJob
+//
+// from and to are RFC 3339 times selecting captures written in between.
+// With a token file every request needs an `Authorization: Bearer <token>`
+// header. The file is read for each request, so the token can be rotated
+// under a running server.
+
+const (
+	capturesPath = "/api/v1/captures"
+	jobsPath     = "/api/v1/jobs/"
+)
+
+// httpAPI serves the captures found in dirs.
+type httpAPI struct {
+	server server
+	dirs   []string
+	// tokenFile holds the bearer token requests need, if any.
+	tokenFile string
+}
+
+func (s server) serveHTTP(port string, dirs []string, tokenFile string) {
+
+	api := &httpAPI{server: s, dirs: dirs, tokenFile: tokenFile}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(capturesPath, api.listCaptures)
+	mux.HandleFunc(capturesPath+"/", api.capture)
+	mux.HandleFunc(jobsPath, api.jobBundle)
+
+	if err := http.ListenAndServe(":"+port, api.authenticate(mux)); err != nil {
+		log.Fatalf("failed to serve http: %v", err)
+	}
+}
+
+// authenticate lets through the requests bearing the token of the token file.
+func (a *httpAPI) authenticate(next http.Handler) http.Handler {
+
+	if a.tokenFile == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := os.ReadFile(a.tokenFile)
+		if err != nil {
+			log.Printf("error reading token: %v", err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		want := strings.TrimSpace(string(token))
+		header := r.Header.Get("Authorization")
+		got := strings.TrimPrefix(header, "Bearer ")
+		if want == "" || got == header || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *httpAPI) listCaptures(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := captureFilter{
+		namespace: query.Get("namespace"),
+		pod:       query.Get("pod"),
+		job:       query.Get("job"),
+	}
+	for key, t := range map[string]*time.Time{"from": &filter.from, "to": &filter.to} {
+		if value := query.Get(key); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %v", key, err), http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	captures, err := a.server.listCaptures(a.dirs, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, captures)
+}
+
+// capture describes a capture, or downloads it under <file>/data.
+func (a *httpAPI) capture(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, capturesPath+"/")
+	download := strings.HasSuffix(name, "/data")
+	name = strings.TrimSuffix(name, "/data")
+
+	info, err := a.server.findCapture(a.dirs, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if info == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !download {
+		writeJSON(w, info)
+		return
+	}
+
+	f, err := os.Open(info.path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// ServeContent answers Range requests.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", info.File))
+	http.ServeContent(w, r, info.File, info.ModTime, f)
+}
+
+// jobBundle streams the captures of a SnoopyJob as a tar or zip archive,
+// with a directory per namespace.
+func (a *httpAPI) jobBundle(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, jobsPath), "/bundle")
+	if job == "" || strings.Contains(job, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "tar"
+	}
+	if format != "tar" && format != "zip" {
+		http.Error(w, "format must be tar or zip", http.StatusBadRequest)
+		return
+	}
+
+	captures, err := a.server.listCaptures(a.dirs, captureFilter{job: job})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(captures) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", job+"."+format))
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		err = writeZip(w, captures)
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+		err = writeTar(w, captures)
+	}
+	// The headers are gone already, the archive is left incomplete.
+	if err != nil {
+		log.Printf("error bundling captures of job %v: %v", job, err)
+	}
+}
+
+// bundlePath is where a capture goes in a bundle, under the directory of its
+// namespace. Namespaces holding a path, only found in descriptions written
+// before they were checked, are dropped.
+func bundlePath(info *captureInfo) string {
+	if !validName(info.Namespace) {
+		return info.File
+	}
+	return path.Join(info.Namespace, info.File)
+}
+
+func writeTar(w io.Writer, captures []*captureInfo) error {
+
+	tw := tar.NewWriter(w)
+	for _, info := range captures {
+		f, err := os.Open(info.path)
+		if err != nil {
+			return err
+		}
+		// Live captures are bundled as they stand.
+		stat, err := f.Stat()
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{
+				Name:    bundlePath(info),
+				Mode:    0644,
+				Size:    stat.Size(),
+				ModTime: stat.ModTime(),
+			})
+		}
+		if err == nil {
+			_, err = io.CopyN(tw, f, stat.Size())
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeZip(w io.Writer, captures []*captureInfo) error {
+
+	zw := zip.NewWriter(w)
+	for _, info := range captures {
+		f, err := os.Open(info.path)
+		if err != nil {
+			return err
+		}
+		entry, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     bundlePath(info),
+			Method:   zip.Deflate,
+			Modified: info.ModTime,
+		})
+		if err == nil {
+			_, err = io.Copy(entry, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing response: %v", err)
+	}
+}
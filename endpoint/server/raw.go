@@ -0,0 +1,151 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// maxPreambleSize bounds the preamble line of a raw connection.
+const maxPreambleSize = 1024
+
+// preambleTimeout is how long a raw connection has to send its preamble.
+const preambleTimeout = 10 * time.Second
+
+// serveRaw accepts plain TCP connections and stores what they send in dir,
+// the way ExportPodData stores gRPC streams.
+func (s server) serveRaw(lis net.Listener, dir string) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			log.Printf("raw accept error %v", err)
+			return
+		}
+		go s.receiveRaw(conn, dir)
+	}
+}
+
+// receiveRaw reads the preamble of a raw connection and appends the rest of
+// it to the file of the pod it names.
+func (s server) receiveRaw(conn net.Conn, dir string) {
+
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(preambleTimeout))
+	reader := bufio.NewReaderSize(conn, maxPreambleSize)
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		log.Printf("raw preamble error from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	meta, err := parsePreamble(string(line))
+	if err != nil {
+		log.Printf("raw preamble error from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	name := meta.Stream
+	log.Printf("start raw stream for pod %v of job %v", name, meta.Job)
+
+	c := newCapture(dir, name, s.retention, meta)
+
+	st := &stream{name: name, capture: c, finalize: make(chan string, 1)}
+	s.streams.add(st)
+	defer s.streams.remove(st)
+
+	s.stats.streamStarted()
+	defer s.stats.streamEnded()
+
+	// Closing the connection ends the read below.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case reason := <-st.finalize:
+			log.Printf("finalize raw stream for pod %v: %v", name, reason)
+			markTruncated(c.file(), reason)
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			s.stats.received(n)
+			if err := c.write(buf[:n]); err != nil {
+				log.Printf("error writing %v: %v", c.file(), err)
+				return
+			}
+		}
+		if err == io.EOF {
+			log.Printf("end raw stream for pod %v", name)
+			return
+		}
+		if err != nil {
+			log.Printf("raw receive error for pod %v: %v", name, err)
+			return
+		}
+	}
+}
+
+// parsePreamble reads the pod, tag, namespace and job of a raw connection
+// from its first line, pod=<name> [tag=<tag>] [namespace=<namespace>]
+// [job=<snoopyJob>]. The stream is stored under <pod> or <pod>-<tag> like
+// tagged gRPC streams.
+func parsePreamble(line string) (captureMeta, error) {
+
+	fields := map[string]string{}
+	for _, field := range strings.Fields(line) {
+		keyValue := strings.SplitN(field, "=", 2)
+		if len(keyValue) != 2 {
+			return captureMeta{}, fmt.Errorf("malformed preamble field %q", field)
+		}
+		fields[keyValue[0]] = keyValue[1]
+	}
+
+	name := fields["pod"]
+	if name == "" {
+		return captureMeta{}, fmt.Errorf("preamble names no pod")
+	}
+	if tag := fields["tag"]; tag != "" {
+		name += "-" + tag
+	}
+
+	// The name becomes a file name in the capture directory.
+	if !validName(name) {
+		return captureMeta{}, fmt.Errorf("invalid stream name %q", name)
+	}
+	// The namespace becomes a directory in the bundles of SnoopyJobs.
+	if namespace := fields["namespace"]; namespace != "" && !validName(namespace) {
+		return captureMeta{}, fmt.Errorf("invalid namespace %q", namespace)
+	}
+
+	return captureMeta{
+		Stream:    name,
+		Namespace: fields["namespace"],
+		Pod:       fields["pod"],
+		Job:       fields["job"],
+		Start:     time.Now().UTC(),
+	}, nil
+}
@@ -0,0 +1,132 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParsePreamble(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		line    string
+		meta    captureMeta
+		invalid bool
+	}{
+		{
+			name: "pod only",
+			line: "pod=web-0",
+			meta: captureMeta{Stream: "web-0", Pod: "web-0"},
+		},
+		{
+			name: "all fields",
+			line: "pod=web-0 tag=dump namespace=shop job=capture",
+			meta: captureMeta{Stream: "web-0-dump", Namespace: "shop", Pod: "web-0", Job: "capture"},
+		},
+		{
+			name: "fields in any order and spacing",
+			line: "  job=capture\tnamespace=shop pod=web-0  ",
+			meta: captureMeta{Stream: "web-0", Namespace: "shop", Pod: "web-0", Job: "capture"},
+		},
+		{
+			name: "empty tag",
+			line: "pod=web-0 tag=",
+			meta: captureMeta{Stream: "web-0", Pod: "web-0"},
+		},
+		{
+			name: "value with equal sign",
+			line: "pod=web-0 tag=a=b",
+			meta: captureMeta{Stream: "web-0-a=b", Pod: "web-0"},
+		},
+		{
+			name: "unknown fields ignored",
+			line: "pod=web-0 node=worker-1",
+			meta: captureMeta{Stream: "web-0", Pod: "web-0"},
+		},
+		{
+			name:    "empty line",
+			line:    "",
+			invalid: true,
+		},
+		{
+			name:    "no pod",
+			line:    "namespace=shop tag=dump",
+			invalid: true,
+		},
+		{
+			name:    "empty pod",
+			line:    "pod= tag=dump",
+			invalid: true,
+		},
+		{
+			name:    "field without value",
+			line:    "pod=web-0 tag",
+			invalid: true,
+		},
+		{
+			name:    "path in pod",
+			line:    "pod=../etc",
+			invalid: true,
+		},
+		{
+			name:    "path in tag",
+			line:    "pod=web-0 tag=a/b",
+			invalid: true,
+		},
+		{
+			name:    "backslash in pod",
+			line:    `pod=web\0`,
+			invalid: true,
+		},
+		{
+			name:    "dot dot pod",
+			line:    "pod=..",
+			invalid: true,
+		},
+		{
+			name:    "path in namespace",
+			line:    "pod=web-0 namespace=../../x",
+			invalid: true,
+		},
+		{
+			name:    "dot namespace",
+			line:    "pod=web-0 namespace=.",
+			invalid: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			meta, err := parsePreamble(test.line)
+			if test.invalid {
+				if err == nil {
+					t.Errorf("got %+v, want an error", meta)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if meta.Start.IsZero() {
+				t.Errorf("start time not set")
+			}
+			meta.Start = test.meta.Start
+			if meta != test.meta {
+				t.Errorf("meta = %+v, want %+v", meta, test.meta)
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With a retention policy the data of a stream is written straight to
+// <name>.<run>.<segment>, moving on to the next segment when it reaches the
+// size or age limit of a capture. <run> is when the stream started, a second
+// later when another stream of the same name started in the same second, so
+// each stream has files of its own. <segment> numbers the files of the run.
+// Only files no stream is writing to are pruned.
+
+// runLayout formats the start of a run in the name of its files.
+const runLayout = "20060102T150405Z"
+
+// truncatedSuffix marks the file recording why a capture was cut short.
+const truncatedSuffix = ".truncated"
+
+// pruneInterval is how often the capture directories are pruned.
+const pruneInterval = time.Minute
+
+// retention limits how much captured data is kept. Zero values are no limit.
+type retention struct {
+	maxAge           time.Duration
+	maxTotalSize     int64
+	maxCaptureSize   int64
+	rotationInterval time.Duration
+	keepRuns         int
+
+	// live tells whether a stream is writing to a file, which is not pruned.
+	live func(file string) bool
+
+	// What was pruned since the server started.
+	prunedFiles   int64
+	prunedBytes   int64
+	lastPruneTime int64
+}
+
+// enabled tells whether captures are rotated and pruned.
+func (r *retention) enabled() bool {
+	return r.maxAge > 0 || r.maxTotalSize > 0 || r.maxCaptureSize > 0 || r.rotationInterval > 0 || r.keepRuns > 0
+}
+
+// capture writes the data of a stream to its file, rotating it at the
+// boundaries of the retention policy.
+type capture struct {
+	dir       string
+	name      string
+	retention *retention
+	meta      captureMeta
+
+	run          time.Time
+	segmentStart time.Time
+	size         int64
+
+	// segment is read by the HTTP API while the stream writes.
+	mu      sync.Mutex
+	segment int
+}
+
+// newCapture starts the capture of a stream, recording its description next to its file.
+func newCapture(dir string, name string, retention *retention, meta captureMeta) *capture {
+	c := &capture{dir: dir, name: name, retention: retention, meta: meta, run: meta.Start, segmentStart: meta.Start}
+	if retention.enabled() {
+		c.claimRun()
+	}
+	if err := writeMeta(c.file(), meta); err != nil {
+		log.Printf("error describing %v: %v", c.file(), err)
+	}
+	return c
+}
+
+// claimRun creates the first file of the run of the capture, moving the run
+// on by a second while another stream of the same name has it.
+func (c *capture) claimRun() {
+	for {
+		f, err := os.OpenFile(c.file(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return
+		}
+		if !os.IsExist(err) {
+			log.Printf("error creating %v: %v", c.file(), err)
+			return
+		}
+		c.run = c.run.Add(time.Second)
+	}
+}
+
+// file is where the data of the stream is being written, <name> or the
+// current segment with a retention policy.
+func (c *capture) file() string {
+	if !c.retention.enabled() {
+		return filepath.Join(c.dir, c.name)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return filepath.Join(c.dir, segmentName(c.name, c.run, c.segment))
+}
+
+// segmentName names a file of a run, <name>.<run>.<segment>.
+func segmentName(name string, run time.Time, segment int) string {
+	return fmt.Sprintf("%s.%s.%03d", name, run.UTC().Format(runLayout), segment)
+}
+
+// write appends data to the capture, moving on to the next segment first
+// when it is full or old enough.
+func (c *capture) write(data []byte) error {
+
+	if c.retention.enabled() && c.size > 0 {
+		full := c.retention.maxCaptureSize > 0 && c.size+int64(len(data)) > c.retention.maxCaptureSize
+		old := c.retention.rotationInterval > 0 && time.Since(c.segmentStart) >= c.retention.rotationInterval
+		if full || old {
+			if err := c.rotate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	f, err := os.OpenFile(c.file(), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := f.Write(data)
+	c.size += int64(n)
+	return err
+}
+
+// rotate moves the capture on to the next segment of its run, along with a
+// copy of its description.
+func (c *capture) rotate() error {
+
+	c.mu.Lock()
+	c.segment++
+	c.mu.Unlock()
+
+	c.segmentStart = time.Now()
+	c.size = 0
+	return writeMeta(c.file(), c.meta)
+}
+
+// rotateOrphans moves the files left by streams written to without a
+// retention policy, or by a server older than per stream files, to a run of
+// their own so they are pruned like any other. It runs before any stream
+// starts.
+func rotateOrphans(dir string) error {
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if _, _, rotated := parseRotated(name); rotated || strings.HasSuffix(name, metaSuffix) || strings.HasSuffix(name, truncatedSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		file := filepath.Join(dir, name)
+		run := info.ModTime().Truncate(time.Second)
+		segment := filepath.Join(dir, segmentName(name, run, 0))
+		for {
+			if _, err := os.Lstat(segment); os.IsNotExist(err) {
+				break
+			}
+			run = run.Add(time.Second)
+			segment = filepath.Join(dir, segmentName(name, run, 0))
+		}
+
+		if err := os.Rename(file, segment); err != nil {
+			return err
+		}
+		for _, suffix := range []string{metaSuffix, truncatedSuffix} {
+			if err := os.Rename(file+suffix, segment+suffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		log.Printf("rotated orphaned %v to %v", file, segment)
+	}
+
+	return nil
+}
+
+// rotatedFile is a file of a run of a capture.
+type rotatedFile struct {
+	path    string
+	name    string
+	run     string
+	size    int64
+	modTime time.Time
+}
+
+// parseRotated reads the name and the run of a rotated file, <name>.<run>.<segment>.
+func parseRotated(base string) (string, string, bool) {
+
+	parts := strings.Split(base, ".")
+	if len(parts) < 3 {
+		return "", "", false
+	}
+
+	run, segment := parts[len(parts)-2], parts[len(parts)-1]
+	if _, err := time.Parse(runLayout, run); err != nil {
+		return "", "", false
+	}
+	if _, err := strconv.Atoi(segment); err != nil {
+		return "", "", false
+	}
+
+	return strings.Join(parts[:len(parts)-2], "."), run, true
+}
+
+// prune applies the retention policy to the given capture directories every pruneInterval.
+func (r *retention) prune(dirs []string) {
+	for {
+		for _, dir := range dirs {
+			if err := r.pruneDir(dir); err != nil {
+				log.Printf("error pruning %v: %v", dir, err)
+			}
+		}
+		time.Sleep(pruneInterval)
+	}
+}
+
+// pruneDir removes the files of dir no stream is writing to beyond the last
+// keepRuns runs of each stream, those older than maxAge, and then the oldest
+// ones while the directory holds more than maxTotalSize.
+func (r *retention) pruneDir(dir string) error {
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	rotated := []rotatedFile{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		total += info.Size()
+
+		path := filepath.Join(dir, entry.Name())
+		name, run, ok := parseRotated(entry.Name())
+		if !ok || (r.live != nil && r.live(path)) {
+			continue
+		}
+		rotated = append(rotated, rotatedFile{
+			path:    path,
+			name:    name,
+			run:     run,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	// Oldest first.
+	sort.Slice(rotated, func(i, j int) bool {
+		return rotated[i].modTime.Before(rotated[j].modTime)
+	})
+
+	pruned := map[string]bool{}
+	remove := func(file rotatedFile) {
+		if pruned[file.path] {
+			return
+		}
+		if err := os.Remove(file.path); err != nil {
+			log.Printf("error pruning %v: %v", file.path, err)
+			return
+		}
+		_ = os.Remove(file.path + truncatedSuffix)
+		_ = os.Remove(file.path + metaSuffix)
+		pruned[file.path] = true
+		total -= file.size
+		atomic.AddInt64(&r.prunedFiles, 1)
+		atomic.AddInt64(&r.prunedBytes, file.size)
+		atomic.StoreInt64(&r.lastPruneTime, time.Now().Unix())
+		log.Printf("pruned %v", file.path)
+	}
+
+	if r.keepRuns > 0 {
+		runs := map[string][]string{}
+		for _, file := range rotated {
+			if !containsString(runs[file.name], file.run) {
+				runs[file.name] = append(runs[file.name], file.run)
+			}
+		}
+		for name := range runs {
+			// Runs are named after their start, so they sort in time order.
+			sort.Sort(sort.Reverse(sort.StringSlice(runs[name])))
+			if len(runs[name]) > r.keepRuns {
+				runs[name] = runs[name][:r.keepRuns]
+			}
+		}
+		for _, file := range rotated {
+			if !containsString(runs[file.name], file.run) {
+				remove(file)
+			}
+		}
+	}
+
+	if r.maxAge > 0 {
+		for _, file := range rotated {
+			if time.Since(file.modTime) > r.maxAge {
+				remove(file)
+			}
+		}
+	}
+
+	if r.maxTotalSize > 0 {
+		for _, file := range rotated {
+			if total <= r.maxTotalSize {
+				break
+			}
+			remove(file)
+		}
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseRotated(t *testing.T) {
+
+	tests := []struct {
+		base    string
+		name    string
+		run     string
+		rotated bool
+	}{
+		{base: "web-0.20240102T030405Z.000", name: "web-0", run: "20240102T030405Z", rotated: true},
+		{base: "web-0-dump.20240102T030405Z.012", name: "web-0-dump", run: "20240102T030405Z", rotated: true},
+		{base: "node-worker.1.example.20240102T030405Z.1000", name: "node-worker.1.example", run: "20240102T030405Z", rotated: true},
+		{base: "web-0"},
+		{base: "web-0.meta"},
+		{base: "web-0.20240102T030405Z"},
+		{base: "web-0.20240102T030405Z.000.meta"},
+		{base: "web-0.20240102T030405Z.000.truncated"},
+		{base: "web-0.2024-01-02.000"},
+		{base: "web-0.20240102T030405Z.abc"},
+		{base: ".20240102T030405Z.000", name: "", run: "20240102T030405Z", rotated: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.base, func(t *testing.T) {
+			name, run, rotated := parseRotated(test.base)
+			if name != test.name || run != test.run || rotated != test.rotated {
+				t.Errorf("parseRotated(%q) = %q, %q, %v, want %q, %q, %v",
+					test.base, name, run, rotated, test.name, test.run, test.rotated)
+			}
+		})
+	}
+}
+
+func TestPruneDir(t *testing.T) {
+
+	now := time.Now()
+
+	// file is a file of the capture directory, written age ago.
+	type file struct {
+		name string
+		size int
+		age  time.Duration
+	}
+
+	files := []file{
+		{name: "web-0.20240101T000000Z.000", size: 100, age: 5 * time.Hour},
+		{name: "web-0.20240101T000000Z.001", size: 100, age: 4 * time.Hour},
+		{name: "web-0.20240102T000000Z.000", size: 100, age: 3 * time.Hour},
+		{name: "web-0.20240103T000000Z.000", size: 100, age: 2 * time.Hour},
+		{name: "web-1.20240101T000000Z.000", size: 100, age: 90 * time.Minute},
+		{name: "web-1.20240102T000000Z.000", size: 100, age: time.Hour},
+		{name: "web-1.20240103T000000Z.000", size: 100, age: 6 * time.Hour},
+		{name: "web-2", size: 100, age: 10 * time.Hour},
+	}
+
+	tests := []struct {
+		name      string
+		retention retention
+		live      string
+		pruned    []string
+	}{
+		{
+			name:      "no limits",
+			retention: retention{},
+		},
+		{
+			name:      "keep runs",
+			retention: retention{keepRuns: 2},
+			pruned:    []string{"web-0.20240101T000000Z.000", "web-0.20240101T000000Z.001", "web-1.20240101T000000Z.000"},
+		},
+		{
+			name:      "max age",
+			retention: retention{maxAge: 150 * time.Minute},
+			pruned: []string{"web-0.20240101T000000Z.000", "web-0.20240101T000000Z.001",
+				"web-0.20240102T000000Z.000", "web-1.20240103T000000Z.000"},
+		},
+		{
+			name:      "max total size",
+			retention: retention{maxTotalSize: 550},
+			pruned:    []string{"web-0.20240101T000000Z.000", "web-1.20240103T000000Z.000", "web-0.20240101T000000Z.001"},
+		},
+		{
+			name:      "live file kept",
+			retention: retention{maxAge: time.Minute},
+			live:      "web-1.20240102T000000Z.000",
+			pruned: []string{"web-0.20240101T000000Z.000", "web-0.20240101T000000Z.001", "web-0.20240102T000000Z.000",
+				"web-0.20240103T000000Z.000", "web-1.20240101T000000Z.000", "web-1.20240103T000000Z.000"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			dir := t.TempDir()
+			for _, f := range files {
+				path := filepath.Join(dir, f.name)
+				if err := os.WriteFile(path, make([]byte, f.size), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path+metaSuffix, []byte("{}"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				modTime := now.Add(-f.age)
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r := test.retention
+			if test.live != "" {
+				r.live = func(file string) bool {
+					return file == filepath.Join(dir, test.live)
+				}
+			}
+			if err := r.pruneDir(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			pruned := []string{}
+			for _, f := range files {
+				if _, err := os.Stat(filepath.Join(dir, f.name)); os.IsNotExist(err) {
+					pruned = append(pruned, f.name)
+					if _, err := os.Stat(filepath.Join(dir, f.name+metaSuffix)); !os.IsNotExist(err) {
+						t.Errorf("description of %v left behind", f.name)
+					}
+				}
+			}
+			want := append([]string{}, test.pruned...)
+			sort.Strings(pruned)
+			sort.Strings(want)
+			if !reflect.DeepEqual(pruned, want) {
+				t.Errorf("pruned %v, want %v", pruned, want)
+			}
+			if r.prunedFiles != int64(len(want)) || r.prunedBytes != int64(100*len(want)) {
+				t.Errorf("counted %d files and %d bytes pruned, want %d and %d", r.prunedFiles, r.prunedBytes, len(want), 100*len(want))
+			}
+		})
+	}
+}
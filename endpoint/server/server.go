@@ -15,11 +15,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 
 	pb "github.com/fennec-project/snoopy-operator/endpoint/proto"
 
@@ -28,6 +30,10 @@ import (
 
 type server struct {
 	pb.UnimplementedDataEndpointServer
+
+	streams   *streams
+	stats     *ingestStats
+	retention *retention
 }
 
 func (s server) ExportPodData(srv pb.DataEndpoint_ExportPodDataServer) error {
@@ -36,26 +42,85 @@ func (s server) ExportPodData(srv pb.DataEndpoint_ExportPodDataServer) error {
 
 	ctx := srv.Context()
 
+	stop, err := newStopCondition(ctx)
+	if err != nil {
+		return err
+	}
+
+	st := &stream{finalize: make(chan string, 1)}
+	defer s.streams.remove(st)
+
+	var c *capture
+
+	s.stats.streamStarted()
+	defer s.stats.streamEnded()
+
+	// Receive in the background so the stream can be finalized while it waits for data.
+	received := make(chan *pb.PodData)
+	receiveErr := make(chan error, 1)
+	go func() {
+		for {
+			pd, err := srv.Recv()
+			if err != nil {
+				receiveErr <- err
+				return
+			}
+			select {
+			case received <- pd:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
 	for {
 
+		var pd *pb.PodData
+
 		// exit if context is done
 		// or continue
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		default:
-		}
 
-		// receive data from stream
-		pd, err := srv.Recv()
-		if err == io.EOF {
-			// return will close stream from server side
-			log.Println("exit")
+		case reason := <-st.finalize:
+			// Closing the stream tells podtracer to stop the command.
+			log.Printf("finalize stream for pod %v: %v", st.name, reason)
+			if c != nil {
+				markTruncated(c.file(), reason)
+			}
+			if err := srv.Send(&pb.Response{Message: "stop: " + reason}); err != nil {
+				log.Printf("send error %v", err)
+			}
 			return nil
-		}
-		if err != nil {
+
+		case err := <-receiveErr:
+			if err == io.EOF {
+				// return will close stream from server side
+				log.Println("exit")
+				return nil
+			}
 			log.Printf("receive error %v", err)
-			continue
+			return err
+
+		case pd = <-received:
+		}
+
+		if st.name == "" {
+			// The name becomes a file name in the capture directory.
+			if !validName(pd.Name) {
+				log.Printf("invalid stream name %q", pd.Name)
+				return fmt.Errorf("invalid stream name %q", pd.Name)
+			}
+			meta, err := streamMeta(ctx, pd.Name)
+			if err != nil {
+				log.Printf("invalid stream metadata for pod %v: %v", pd.Name, err)
+				return err
+			}
+			st.name = pd.Name
+			c = newCapture("/pcap", pd.Name, s.retention, meta)
+			st.capture = c
+			s.streams.add(st)
 		}
 
 		// Send response back to client
@@ -65,18 +130,22 @@ func (s server) ExportPodData(srv pb.DataEndpoint_ExportPodDataServer) error {
 		}
 		// log.Printf("Received data for pod %v", pd.Name)
 
-		// open a file to write and append podData
-		f, err := os.OpenFile("/pcap/"+pd.Name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
-		if err != nil {
-			fmt.Print(err.Error())
-			log.Fatal("Error openning file to write data on server.")
-		}
-		_, err = f.Write(pd.Data)
-		if err != nil {
+		// append podData to the capture
+		data, reason := stop.check(pd.Data)
+		s.stats.received(len(pd.Data))
+		if err := c.write(data); err != nil {
 			fmt.Print(err.Error())
 			log.Fatal("Error writing data to file on server.")
 		}
-		f.Close()
+
+		// Closing the stream tells podtracer to stop the command.
+		if reason != "" {
+			log.Printf("stop stream for pod %v: %v", pd.Name, reason)
+			if err := srv.Send(&pb.Response{Message: "stop: " + reason}); err != nil {
+				log.Printf("send error %v", err)
+			}
+			return nil
+		}
 	}
 }
 
@@ -86,6 +155,55 @@ func main() {
 	// address := os.Args[1]
 	port := os.Args[1]
 
+	// Options follow the port.
+	rawPort := flag.String("raw-port", "", "port of the plain TCP listener, disabled when empty")
+	rawDir := flag.String("raw-dir", "/pcap", "directory plain TCP streams are written to")
+	httpPort := flag.String("http-port", "", "port of the HTTP API serving the captures, disabled when empty")
+	httpTokenFile := flag.String("http-token-file", "", "file holding the bearer token the HTTP API requires, none when empty")
+	retention := &retention{}
+	flag.DurationVar(&retention.maxAge, "max-age", 0, "prune captures older than this")
+	flag.Int64Var(&retention.maxTotalSize, "max-total-size", 0, "prune the oldest captures beyond this many bytes in all")
+	flag.Int64Var(&retention.maxCaptureSize, "max-capture-size", 0, "rotate captures reaching this many bytes")
+	flag.DurationVar(&retention.rotationInterval, "rotation-interval", 0, "rotate captures written for this long")
+	flag.IntVar(&retention.keepRuns, "keep-runs", 0, "keep the captures of this many last runs of each stream")
+	if err := flag.CommandLine.Parse(os.Args[2:]); err != nil {
+		log.Fatalf("failed to parse options: %v", err)
+	}
+
+	s := &server{streams: newStreams(), stats: &ingestStats{}, retention: retention}
+
+	dirs := []string{"/pcap"}
+	if *rawPort != "" && filepath.Clean(*rawDir) != "/pcap" {
+		if err := os.MkdirAll(*rawDir, 0755); err != nil {
+			log.Fatalf("failed to create %v: %v", *rawDir, err)
+		}
+		dirs = append(dirs, *rawDir)
+	}
+
+	if retention.enabled() {
+		for _, dir := range dirs {
+			if err := rotateOrphans(dir); err != nil {
+				log.Printf("error rotating orphaned captures of %v: %v", dir, err)
+			}
+		}
+		retention.live = s.streams.writing
+		go retention.prune(dirs)
+	}
+
+	if *httpPort != "" {
+		fmt.Printf("Serving captures on port %s", *httpPort)
+		go s.serveHTTP(*httpPort, dirs, *httpTokenFile)
+	}
+
+	if *rawPort != "" {
+		rawLis, err := net.Listen("tcp", ":"+*rawPort)
+		if err != nil {
+			log.Fatalf("failed to listen: %v", err)
+		}
+		fmt.Printf("Listening for raw streams on port %s", *rawPort)
+		go s.serveRaw(rawLis, *rawDir)
+	}
+
 	// create listener
 	lis, err := net.Listen("tcp", ":"+port)
 	if err != nil {
@@ -93,11 +211,11 @@ func main() {
 	}
 	fmt.Printf("Listening on port %s", port)
 	// create grpc server
-	s := grpc.NewServer()
-	pb.RegisterDataEndpointServer(s, &server{})
+	grpcServer := grpc.NewServer()
+	pb.RegisterDataEndpointServer(grpcServer, s)
 
 	// and start...
-	if err := s.Serve(lis); err != nil {
+	if err := grpcServer.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}
 
@@ -0,0 +1,60 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	pb "github.com/fennec-project/snoopy-operator/endpoint/proto"
+)
+
+// ingestStats counts what the server received since it started.
+type ingestStats struct {
+	activeStreams int32
+	bytesReceived int64
+}
+
+func (s *ingestStats) streamStarted() {
+	atomic.AddInt32(&s.activeStreams, 1)
+}
+
+func (s *ingestStats) streamEnded() {
+	atomic.AddInt32(&s.activeStreams, -1)
+}
+
+func (s *ingestStats) received(n int) {
+	atomic.AddInt64(&s.bytesReceived, int64(n))
+}
+
+func (s server) GetStats(ctx context.Context, req *pb.StatsRequest) (*pb.StatsResponse, error) {
+
+	resp := &pb.StatsResponse{
+		ActiveStreams: atomic.LoadInt32(&s.stats.activeStreams),
+		BytesReceived: atomic.LoadInt64(&s.stats.bytesReceived),
+		PrunedFiles:   atomic.LoadInt64(&s.retention.prunedFiles),
+		PrunedBytes:   atomic.LoadInt64(&s.retention.prunedBytes),
+		LastPruneTime: atomic.LoadInt64(&s.retention.lastPruneTime),
+	}
+
+	used, capacity, err := storageUsage("/pcap")
+	if err != nil {
+		return nil, err
+	}
+	resp.StorageUsedBytes = used
+	resp.StorageCapacityBytes = capacity
+
+	return resp, nil
+}
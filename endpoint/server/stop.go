@@ -0,0 +1,83 @@
+// Copyright The Snoopy Operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Stream metadata keys podtracer sets from the SnoopyJob stop condition.
+const (
+	maxBytesKey    = "snoopy-max-bytes"
+	stopPatternKey = "snoopy-stop-pattern"
+)
+
+// stopCondition ends a stream once it has sent maxBytes or its data matched pattern.
+type stopCondition struct {
+	maxBytes int64
+	pattern  *regexp.Regexp
+	received int64
+}
+
+// newStopCondition reads the stop condition of a stream from its metadata.
+func newStopCondition(ctx context.Context) (*stopCondition, error) {
+
+	stop := &stopCondition{}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return stop, nil
+	}
+
+	if values := md.Get(maxBytesKey); len(values) > 0 {
+		maxBytes, err := strconv.ParseInt(values[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		stop.maxBytes = maxBytes
+	}
+
+	if values := md.Get(stopPatternKey); len(values) > 0 && values[0] != "" {
+		pattern, err := regexp.Compile(values[0])
+		if err != nil {
+			return nil, err
+		}
+		stop.pattern = pattern
+	}
+
+	return stop, nil
+}
+
+// check returns the part of data to keep and the reason to stop the stream,
+// empty while it goes on.
+func (s *stopCondition) check(data []byte) ([]byte, string) {
+
+	if s.maxBytes > 0 && s.received+int64(len(data)) >= s.maxBytes {
+		data = data[:s.maxBytes-s.received]
+		s.received = s.maxBytes
+		return data, "MaxBytes"
+	}
+	s.received += int64(len(data))
+
+	if s.pattern != nil && s.pattern.Match(data) {
+		return data, "Pattern"
+	}
+
+	return data, ""
+}
@@ -17,6 +17,7 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -24,6 +25,7 @@ import (
 
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
@@ -53,11 +55,21 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var maxConcurrentReconciles int
+	var podtracerImage string
+	var podtracerFeatures string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"The number of SnoopyJobs and SnoopyConnectivityChecks reconciled at once.")
+	flag.StringVar(&podtracerImage, "podtracer-image", "",
+		"The podtracer image worker Pods run. Defaults to the pinned podtracer release.")
+	flag.StringVar(&podtracerFeatures, "podtracer-features", "",
+		"Comma separated podtracer features the podtracer image supports beyond the pinned release: "+
+			"tag, host, stop, start-at, shell, job.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -79,8 +91,12 @@ func main() {
 		os.Exit(1)
 	}
 	if err = (&jobcontrollers.SnoopyJobReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		Clientset:               kubernetes.NewForConfigOrDie(mgr.GetConfig()),
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		PodtracerImage:          podtracerImage,
+		PodtracerFeatures:       splitFeatures(podtracerFeatures),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "SnoopyJob")
 		os.Exit(1)
@@ -92,6 +108,15 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "SnoopyDataEndpoint")
 		os.Exit(1)
 	}
+	if err = (&jobcontrollers.SnoopyConnectivityCheckReconciler{
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		Clientset:               kubernetes.NewForConfigOrDie(mgr.GetConfig()),
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "SnoopyConnectivityCheck")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -110,3 +135,14 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitFeatures reads the comma separated list of -podtracer-features.
+func splitFeatures(features string) []string {
+	list := []string{}
+	for _, feature := range strings.Split(features, ",") {
+		if feature = strings.TrimSpace(feature); feature != "" {
+			list = append(list, feature)
+		}
+	}
+	return list
+}